@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"internal/database"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// principal is the caller an access token was issued to, as put into the
+// request context by requireAuth and optionalAuth.
+type principal struct {
+	UserID int
+	// Scopes are from the token's space-separated scope claim. Tokens issued
+	// by Chirpy don't carry any yet.
+	Scopes []string
+	// TokenID is the token's jti, empty for tokens issued before it was
+	// added.
+	TokenID string
+}
+
+type principalKey struct{}
+
+// principalFrom returns the caller stored by requireAuth or optionalAuth.
+// ok is false when the request carried no access token.
+func principalFrom(ctx context.Context) (p principal, ok bool) {
+	p, ok = ctx.Value(principalKey{}).(principal)
+	return p, ok
+}
+
+// requireAuth only lets requests with a valid access token through to next,
+// with the caller in the request context.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenString, found := bearerToken(r)
+		if !found {
+			respondUnauthorized(w, "")
+			return
+		}
+		p, err := parseAccessToken(tokenString)
+		if err != nil {
+			respondUnauthorized(w, err.Error())
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// optionalAuth is requireAuth for endpoints that also serve anonymous
+// callers: a request without a bearer token goes through with no principal,
+// but a bad token is still refused rather than silently ignored.
+func optionalAuth(next http.HandlerFunc) http.HandlerFunc {
+	required := requireAuth(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, found := bearerToken(r); !found {
+			next(w, r)
+			return
+		}
+		required(w, r)
+	}
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header.
+// The scheme name is case-insensitive.
+func bearerToken(r *http.Request) (token string, found bool) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	token = strings.TrimSpace(token)
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// respondUnauthorized sends the 401 for a missing or bad access token,
+// with the WWW-Authenticate challenge from RFC 6750. An empty reason means
+// no token was sent, which per the RFC gets a challenge with no error code.
+func respondUnauthorized(w http.ResponseWriter, reason string) {
+	type errorJSON struct {
+		Error string `json:"error"`
+	}
+	challenge := `Bearer realm="chirpy"`
+	msg := "Missing access token"
+	if reason != "" {
+		challenge += `, error="invalid_token"`
+		msg = reason
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	respondWithJSON(w, 401, errorJSON{Error: msg})
+}
+
+// randomHex returns n random bytes, hex-encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		debug.PrintStack()
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// maxUserAgentLength caps the user agent stored with a refresh token.
+const maxUserAgentLength = 256
+
+// newRefreshToken returns a fresh refresh token for userID, issued in
+// response to r, and the record to store for it. The record isn't in a
+// family yet.
+func newRefreshToken(r *http.Request, userID int) (token string, rToken database.RefreshToken) {
+	now := time.Now().UTC()
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	rToken = database.RefreshToken{UserID: userID, CreatedAt: now, ExpiresAt: now.Add(refreshTokenLifetime), UserAgent: userAgent, IP: ip}
+	return randomHex(32), rToken
+}
+
+// accessClaims are the claims in an access token.
+type accessClaims struct {
+	jwt.RegisteredClaims
+	Scope string `json:"scope,omitempty"`
+}
+
+// accessTokenType is the typ header of access tokens whose subject is the
+// user ID in decimal. Tokens issued before it was added have the "JWT" type
+// and the user ID as a single Unicode code point, see legacySubjectID.
+const accessTokenType = "at+jwt"
+
+// newAccessToken signs a token for u with the JWT_SIGNING_KEY, naming it in
+// the kid header, or with HS256 and JWT_SECRET if there is no signing key.
+func newAccessToken(u database.User) (token string) {
+	expirationTime := time.Now().Add(time.Hour * time.Duration(1))
+	claims := accessClaims{RegisteredClaims: jwt.RegisteredClaims{Issuer: "chirpy", IssuedAt: jwt.NewNumericDate(time.Now().UTC()), Subject: strconv.Itoa(u.Id), ExpiresAt: jwt.NewNumericDate(expirationTime), ID: randomHex(16)}}
+	keys, err := tokenKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var tokenObj *jwt.Token
+	var signWith interface{}
+	if keys.signing != nil {
+		tokenObj = jwt.NewWithClaims(keys.signing.method, claims)
+		tokenObj.Header["kid"] = keys.signing.kid
+		signWith = keys.signing.private
+	} else {
+		tokenObj = jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		signWith = []byte(os.Getenv("JWT_SECRET"))
+	}
+	tokenObj.Header["typ"] = accessTokenType
+	accessToken, err := tokenObj.SignedString(signWith)
+	if err != nil {
+		debug.PrintStack()
+		log.Fatal(err)
+	}
+	return accessToken
+}
+
+// parseAccessToken verifies an access token and returns who it was issued
+// to.
+func parseAccessToken(tokenString string) (principal, error) {
+	claims := accessClaims{}
+	tokenObj, err := jwt.ParseWithClaims(tokenString, &claims, verificationKey,
+		jwt.WithValidMethods([]string{"EdDSA", "RS256", "HS256"}), jwt.WithIssuer("chirpy"), jwt.WithExpirationRequired())
+	if err != nil {
+		return principal{}, err
+	}
+	userID, err := getUserIdFromJwtToken(tokenObj)
+	if err != nil {
+		return principal{}, err
+	}
+	return principal{UserID: userID, Scopes: strings.Fields(claims.Scope), TokenID: claims.ID}, nil
+}
+
+// getUserIdFromJwtToken returns the user ID in the subject of a verified
+// access token. The subject must be a plain positive decimal number; signs,
+// leading zeros and spaces are rejected so each ID has exactly one form.
+func getUserIdFromJwtToken(token *jwt.Token) (userID int, err error) {
+	idString, err := token.Claims.GetSubject()
+	if err != nil {
+		return 0, err
+	}
+	if token.Header["typ"] != accessTokenType {
+		return legacySubjectID(idString)
+	}
+	userID, err = strconv.Atoi(idString)
+	if err != nil || userID <= 0 || strconv.Itoa(userID) != idString {
+		return 0, fmt.Errorf("Invalid token subject %q", idString)
+	}
+	return userID, nil
+}
+
+// legacySubjectID reads the subject of a token issued before
+// accessTokenType, which held the user ID as a single code point. Those
+// tokens are accepted until JWT_LEGACY_SUBJECT_UNTIL, if it is set. IDs
+// that weren't valid code points were encoded as U+FFFD, so they can't be
+// recovered and are rejected.
+func legacySubjectID(subject string) (int, error) {
+	until, _ := legacySubjectDeadline()
+	if !until.IsZero() && time.Now().After(until) {
+		return 0, fmt.Errorf("Tokens in the old format are no longer accepted")
+	}
+	r, size := utf8.DecodeRuneInString(subject)
+	if size == 0 || size != len(subject) || r == utf8.RuneError || r == 0 {
+		return 0, fmt.Errorf("Invalid token subject %q", subject)
+	}
+	return int(r), nil
+}
+
+// legacySubjectDeadline reads JWT_LEGACY_SUBJECT_UNTIL, an RFC 3339 time
+// after which old-format tokens are refused. Unset means they are still
+// accepted. Access tokens last an hour, so an hour after every server runs
+// this version is enough.
+func legacySubjectDeadline() (time.Time, error) {
+	value := os.Getenv("JWT_LEGACY_SUBJECT_UNTIL")
+	if value == "" {
+		return time.Time{}, nil
+	}
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid JWT_LEGACY_SUBJECT_UNTIL %q", value)
+	}
+	return until, nil
+}
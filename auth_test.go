@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"internal/database"
+)
+
+func tokenWithSubject(typ, subject string) *jwt.Token {
+	return &jwt.Token{
+		Header: map[string]interface{}{"typ": typ, "alg": "HS256"},
+		Claims: jwt.RegisteredClaims{Subject: subject},
+	}
+}
+
+func TestGetUserIdFromJwtToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		typ     string
+		subject string
+		want    int
+		wantErr bool
+	}{
+		{"one", accessTokenType, "1", 1, false},
+		{"largest ASCII", accessTokenType, "127", 127, false},
+		{"past ASCII", accessTokenType, "128", 128, false},
+		{"largest byte", accessTokenType, "255", 255, false},
+		{"past a byte", accessTokenType, "256", 256, false},
+		{"large", accessTokenType, "1000000", 1000000, false},
+		{"zero", accessTokenType, "0", 0, true},
+		{"leading zero", accessTokenType, "007", 0, true},
+		{"minus sign", accessTokenType, "-5", 0, true},
+		{"plus sign", accessTokenType, "+5", 0, true},
+		{"leading space", accessTokenType, " 5", 0, true},
+		{"trailing space", accessTokenType, "5 ", 0, true},
+		{"empty", accessTokenType, "", 0, true},
+		{"not a number", accessTokenType, "abc", 0, true},
+		{"exponent", accessTokenType, "1e3", 0, true},
+		{"overflow", accessTokenType, "99999999999999999999", 0, true},
+		{"legacy ASCII", "JWT", "A", 65, false},
+		{"legacy past ASCII", "JWT", string(rune(200)), 200, false},
+		{"legacy past a byte", "JWT", string(rune(300)), 300, false},
+		{"legacy largest code point", "JWT", string(rune(0x10FFFF)), 0x10FFFF, false},
+		// Without the new typ a digit is still read as a code point.
+		{"legacy digit", "JWT", "5", '5', false},
+		{"legacy replacement character", "JWT", "\uFFFD", 0, true},
+		{"legacy two code points", "JWT", "AB", 0, true},
+		{"legacy NUL", "JWT", "\x00", 0, true},
+		{"legacy invalid UTF-8", "JWT", "\xff", 0, true},
+		{"legacy empty", "JWT", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getUserIdFromJwtToken(tokenWithSubject(tt.typ, tt.subject))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLegacySubjectCutoff(t *testing.T) {
+	tests := []struct {
+		name      string
+		until     string
+		typ       string
+		wantErr   bool
+		wantUntil bool
+	}{
+		{"unset", "", "JWT", false, false},
+		{"before the cutoff", time.Now().Add(time.Hour).Format(time.RFC3339), "JWT", false, true},
+		{"after the cutoff", time.Now().Add(-time.Hour).Format(time.RFC3339), "JWT", true, true},
+		{"new format after the cutoff", time.Now().Add(-time.Hour).Format(time.RFC3339), accessTokenType, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("JWT_LEGACY_SUBJECT_UNTIL", tt.until)
+			until, err := legacySubjectDeadline()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if until.IsZero() == tt.wantUntil {
+				t.Errorf("got deadline %v", until)
+			}
+			subject := string(rune(300))
+			if tt.typ == accessTokenType {
+				subject = "300"
+			}
+			got, err := getUserIdFromJwtToken(tokenWithSubject(tt.typ, subject))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && got != 300 {
+				t.Errorf("got %d, want 300", got)
+			}
+		})
+	}
+
+	t.Setenv("JWT_LEGACY_SUBJECT_UNTIL", "tomorrow")
+	_, err := legacySubjectDeadline()
+	if err == nil {
+		t.Error("an invalid JWT_LEGACY_SUBJECT_UNTIL was accepted")
+	}
+}
+
+func TestAccessTokenRoundTrip(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	for _, id := range []int{1, 127, 128, 255, 256, 70000} {
+		caller, err := parseAccessToken(newAccessToken(database.User{Id: id}))
+		if err != nil {
+			t.Fatalf("user %d: %v", id, err)
+		}
+		if caller.UserID != id {
+			t.Errorf("got user %d, want %d", caller.UserID, id)
+		}
+	}
+
+	// A token signed before the typ header was added.
+	claims := jwt.RegisteredClaims{Issuer: "chirpy", Subject: string(rune(300)), ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller, err := parseAccessToken(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caller.UserID != 300 {
+		t.Errorf("legacy token: got user %d, want 300", caller.UserID)
+	}
+}
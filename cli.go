@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"internal/database"
+	"io"
+	"os"
+)
+
+// runCommand runs an admin subcommand, such as `chirpy migrate`, instead of
+// the server and returns the process exit code.
+func runCommand(name string, args []string) int {
+	var err error
+	switch name {
+	case "migrate":
+		err = runMigrate(args)
+	case "backup":
+		err = runBackup(args)
+	case "restore":
+		err = runRestore(args)
+	case "encrypt":
+		err = runEncrypt(args)
+	case "convert":
+		err = runConvert(args)
+	case "export":
+		err = runExport(args)
+	case "import":
+		err = runImport(args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", name)
+		fmt.Fprintln(os.Stderr, "Usage: chirpy [migrate|backup|restore|encrypt|convert|export|import]")
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// runMigrate upgrades the database file to the current schema version. The
+// server does the same on startup; this lets an operator check first with
+// -dry-run.
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would change without writing anything")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	path := dbPath()
+	if *dryRun {
+		opts, err := dbOptions()
+		if err != nil {
+			return err
+		}
+		reports, err := database.PlanMigrations(path, opts)
+		if err != nil {
+			return err
+		}
+		if len(reports) == 0 {
+			fmt.Printf("%s is already at schema version %d\n", path, database.SchemaVersion)
+		}
+		for _, report := range reports {
+			fmt.Println("Would migrate to", report)
+		}
+		return nil
+	}
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is at schema version %d\n", path, database.SchemaVersion)
+	return db.Close()
+}
+
+// runBackup writes an archive of the database to BACKUP_DIR, or -dir, and
+// prunes old archives. It is safe to run while the server is up.
+func runBackup(args []string) error {
+	dir, retain, err := backupSettings()
+	if err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	flags.StringVar(&dir, "dir", dir, "directory to write the archive to")
+	flags.IntVar(&retain, "keep", retain, "number of archives to keep, 0 for all")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	archive, err := db.Backup(dir, retain)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	fmt.Printf("Wrote %s (%s)\n", archive.Path, archive.Checksum)
+	return db.Close()
+}
+
+// runRestore replaces the database with an archive written by runBackup.
+// The archive is always verified first; -check stops there.
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	check := flags.Bool("check", false, "verify the archive without restoring it")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: chirpy restore [-check] <archive>")
+	}
+	path := flags.Arg(0)
+	opts, err := dbOptions()
+	if err != nil {
+		return err
+	}
+	archive, err := database.VerifyArchive(path, opts.Keys)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is intact (%s)\n", archive.Path, archive.Checksum)
+	if *check {
+		return nil
+	}
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	err = db.Restore(path)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	fmt.Printf("Restored %s from %s\n", dbPath(), path)
+	return db.Close()
+}
+
+// openDB opens the file database the server would use.
+func openDB() (*database.DB, error) {
+	opts, err := dbOptions()
+	if err != nil {
+		return nil, err
+	}
+	return database.NewDB(dbPath(), opts)
+}
+
+// runEncrypt rewrites the database files with the active key from
+// DB_ENCRYPTION_KEYS. Use it to encrypt an existing plaintext database or,
+// after rotating keys, to stop depending on the old ones.
+func runEncrypt(args []string) error {
+	flags := flag.NewFlagSet("encrypt", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	opts, err := dbOptions()
+	if err != nil {
+		return err
+	}
+	if opts.Keys == nil {
+		return fmt.Errorf("DB_ENCRYPTION_KEYS is not set")
+	}
+	db, err := database.NewDB(dbPath(), opts)
+	if err != nil {
+		return err
+	}
+	err = db.Rewrite()
+	if err != nil {
+		db.Close()
+		return err
+	}
+	fmt.Printf("Encrypted %s with key %q\n", dbPath(), opts.Keys.ActiveKeyID())
+	fmt.Println("Older backup archives and quarantined files are not rewritten; re-create or delete them.")
+	return db.Close()
+}
+
+// runConvert rewrites the database with the codec given by -to, which
+// defaults to DB_CODEC. Whatever codec the file used before is read from its
+// header.
+func runConvert(args []string) error {
+	opts, err := dbOptions()
+	if err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	to := flags.String("to", opts.Codec.Name(), "codec to write: json, gob, json+gzip or gob+gzip")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	opts.Codec, err = database.CodecByName(*to)
+	if err != nil {
+		return err
+	}
+	db, err := database.NewDB(dbPath(), opts)
+	if err != nil {
+		return err
+	}
+	err = db.Rewrite()
+	if err != nil {
+		db.Close()
+		return err
+	}
+	fmt.Printf("Converted %s to %s\n", dbPath(), opts.Codec.Name())
+	fmt.Println("Set DB_CODEC to match, or the server will write the old codec again.")
+	return db.Close()
+}
+
+// runExport writes users, chirps and tokens to -o, or stdout, as JSONL or
+// CSV. Password hashes are only included with -passwords.
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "jsonl", "jsonl or csv")
+	kinds := flags.String("kinds", "", "comma-separated kinds to export: users, chirps, tokens (default all)")
+	passwords := flags.Bool("passwords", false, "include password hashes")
+	out := flags.String("o", "-", "file to write, - for stdout")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	opts := database.ExportOptions{Format: database.Format(*format), Kinds: recordKinds(*kinds), Passwords: *passwords}
+	err = opts.Check()
+	if err != nil {
+		return err
+	}
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if *out == "-" {
+		return db.Export(os.Stdout, opts)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	err = db.Export(f, opts)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runImport imports a file written by runExport, or stdin with -, and
+// prints the report as JSON. It fails if any record was skipped, so scripts
+// notice; the valid records are still imported unless -dry-run is given.
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "jsonl", "jsonl or csv")
+	dryRun := flags.Bool("dry-run", false, "validate and report without importing")
+	merge := flags.Bool("merge-matched-users", false, "import the chirps of users whose email already exists as theirs")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: chirpy import [-format jsonl|csv] [-dry-run] [-merge-matched-users] <file|->")
+	}
+	var in io.Reader = os.Stdin
+	if path := flags.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	report, err := db.Import(in, database.ImportOptions{Format: database.Format(*format), DryRun: *dryRun, MaxBodyLength: maxChirpLength, MergeMatchedUsers: *merge})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	err = db.Close()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(report)
+	if err != nil {
+		return err
+	}
+	if report.Skipped > 0 {
+		return fmt.Errorf("Skipped %d invalid records", report.Skipped)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Archive is a point-in-time copy of the database written by Backup. It uses
+// the snapshot file format, so its header carries a checksum of the data.
+type Archive struct {
+	Path      string    `json:"path"`
+	Checksum  string    `json:"checksum"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	archivePrefix     = "chirpy-"
+	archiveSuffix     = ".snapshot"
+	archiveTimeLayout = "20060102T150405.000Z"
+)
+
+// Backup writes a consistent copy of the database to a timestamped archive
+// in dir, then deletes all but the newest retain archives there. A retain of
+// zero or less keeps everything.
+func (db *DB) Backup(dir string, retain int) (Archive, error) {
+	err := db.refresh()
+	if err != nil {
+		return Archive{}, err
+	}
+	db.mux.RLock()
+	data := db.data
+	data.JournalSeq = db.journal.seq
+	raw, err := encodeSnapshot(data, db.opts)
+	db.mux.RUnlock()
+	if err != nil {
+		return Archive{}, err
+	}
+	return writeArchive(raw, dir, retain, db.opts.Keys)
+}
+
+// Restore verifies the archive at path and replaces the whole database with
+// its contents. The current snapshot is kept as the backup file, and the ID
+// counters never move backwards, so IDs handed out after the archive was
+// taken are not reused.
+func (db *DB) Restore(path string) error {
+	_, restored, err := readArchive(path, db.opts.Keys)
+	if err != nil {
+		return err
+	}
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	err = db.lock.lock()
+	if err != nil {
+		return ioError("Locking database", err)
+	}
+	defer db.lock.unlock()
+	err = db.sync()
+	if err != nil {
+		return err
+	}
+	restored.NextChirpID = max(restored.NextChirpID, db.data.NextChirpID)
+	restored.NextUserID = max(restored.NextUserID, db.data.NextUserID)
+	restored.EventSeq = max(restored.EventSeq, db.data.EventSeq)
+	// Every record in the journal predates the restore, so mark them all as
+	// folded in before emptying it.
+	restored.JournalSeq = db.journal.seq
+	err = db.writeDB(restored)
+	if err != nil {
+		return err
+	}
+	db.data = restored
+	db.snapshot, err = os.Stat(db.path)
+	if err != nil {
+		return ioError("Writing snapshot", err)
+	}
+	return db.journal.truncate()
+}
+
+// VerifyArchive checks that the archive at path is intact and readable by
+// this build with keys.
+func VerifyArchive(path string, keys *Keyring) (Archive, error) {
+	archive, _, err := readArchive(path, keys)
+	return archive, err
+}
+
+// readArchive verifies an archive and returns its contents at the current
+// schema version.
+func readArchive(path string, keys *Keyring) (Archive, DBStructure, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return Archive{}, DBStructure{}, ioError("Reading archive", err)
+	}
+	header, _, err := splitSnapshot(raw)
+	if err != nil {
+		return Archive{}, DBStructure{}, err
+	}
+	if header == nil {
+		return Archive{}, DBStructure{}, corruptError("Archive %s has no checksum header", path)
+	}
+	dbStructure, err := decodeSnapshot(raw, keys)
+	if err != nil {
+		return Archive{}, DBStructure{}, err
+	}
+	_, err = migrate(&dbStructure)
+	if err != nil {
+		return Archive{}, DBStructure{}, err
+	}
+	archive := Archive{Path: path, Checksum: header.Checksum}
+	stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), archivePrefix), archiveSuffix)
+	archive.CreatedAt, _ = time.Parse(archiveTimeLayout, stamp)
+	return archive, dbStructure, nil
+}
+
+func writeArchive(raw []byte, dir string, retain int, keys *Keyring) (Archive, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return Archive{}, ioError("Creating backup directory", err)
+	}
+	name := archivePrefix + time.Now().UTC().Format(archiveTimeLayout) + archiveSuffix
+	path := filepath.Join(dir, name)
+	err = writeFileAtomic(path, raw)
+	if err != nil {
+		return Archive{}, ioError("Writing archive", err)
+	}
+	// Read it back, so a bad write is reported now rather than at restore.
+	archive, err := VerifyArchive(path, keys)
+	if err != nil {
+		return Archive{}, err
+	}
+	return archive, pruneArchives(dir, retain)
+}
+
+// ListArchives returns the archives in dir, oldest first.
+func ListArchives(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, ioError("Listing backups", err)
+	}
+	paths := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, archivePrefix) && strings.HasSuffix(name, archiveSuffix) {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	// The timestamp in the name sorts chronologically.
+	slices.Sort(paths)
+	return paths, nil
+}
+
+func pruneArchives(dir string, retain int) error {
+	if retain <= 0 {
+		return nil
+	}
+	paths, err := ListArchives(dir)
+	if err != nil {
+		return err
+	}
+	for len(paths) > retain {
+		err = os.Remove(paths[0])
+		if err != nil {
+			return ioError("Removing old backup", err)
+		}
+		paths = paths[1:]
+	}
+	return nil
+}
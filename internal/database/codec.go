@@ -0,0 +1,118 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Codec turns a DBStructure into snapshot bytes and back. The codec's name
+// is recorded in the snapshot header, so a file can always be read whatever
+// codec the current build writes with. Journal records stay JSON; they are
+// small and written one at a time.
+type Codec interface {
+	Name() string
+	Marshal(dbStructure DBStructure) ([]byte, error)
+	Unmarshal(data []byte, dbStructure *DBStructure) error
+}
+
+var (
+	// JSONCodec is the default, and the only format older builds can read.
+	JSONCodec Codec = jsonCodec{}
+	// GobCodec is smaller and faster than JSON, but only readable by Go.
+	GobCodec Codec = gobCodec{}
+)
+
+// Gzip wraps a codec to compress its output.
+func Gzip(inner Codec) Codec {
+	return gzipCodec{inner: inner}
+}
+
+// CodecByName returns the codec with the given name, as written in snapshot
+// headers: "json", "gob", or either with "+gzip" appended. An empty name
+// means JSON, since files written before codecs existed don't record one.
+func CodecByName(name string) (Codec, error) {
+	base, compressed := strings.CutSuffix(name, "+gzip")
+	var codec Codec
+	switch base {
+	case "", "json":
+		codec = JSONCodec
+	case "gob":
+		codec = GobCodec
+	default:
+		return nil, fmt.Errorf("Unknown codec %q", name)
+	}
+	if compressed {
+		codec = Gzip(codec)
+	}
+	return codec, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(dbStructure DBStructure) ([]byte, error) {
+	return json.Marshal(dbStructure)
+}
+
+func (jsonCodec) Unmarshal(data []byte, dbStructure *DBStructure) error {
+	return json.Unmarshal(data, dbStructure)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(dbStructure DBStructure) ([]byte, error) {
+	buf := bytes.Buffer{}
+	err := gob.NewEncoder(&buf).Encode(dbStructure)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, dbStructure *DBStructure) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(dbStructure)
+}
+
+type gzipCodec struct {
+	inner Codec
+}
+
+func (c gzipCodec) Name() string {
+	return c.inner.Name() + "+gzip"
+}
+
+func (c gzipCodec) Marshal(dbStructure DBStructure) ([]byte, error) {
+	raw, err := c.inner.Marshal(dbStructure)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	_, err = w.Write(raw)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	return buf.Bytes(), err
+}
+
+func (c gzipCodec) Unmarshal(data []byte, dbStructure *DBStructure) error {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return c.inner.Unmarshal(raw, dbStructure)
+}
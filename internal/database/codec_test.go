@@ -0,0 +1,81 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCodecsReopen(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, GobCodec, Gzip(JSONCodec), Gzip(GobCodec)} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db := openTestDBWith(t, path, Options{Codec: codec})
+			createTestUsers(t, db, 2)
+			_, err := db.CreateChirp("Hello, world", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chirp, err := db.CreateChirp("Deleted", 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.DeleteChirpByID(chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := dumpStore(t, db)
+			err = db.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			header, _, err := splitSnapshot(mustReadFile(t, path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Codec != codec.Name() {
+				t.Errorf("snapshot codec is %q, want %q", header.Codec, codec.Name())
+			}
+			// The header names the codec, so the file reads back whatever
+			// codec the handle is configured with.
+			for _, opts := range []Options{{Codec: codec}, {}} {
+				if got := dumpStore(t, openTestDBWith(t, path, opts)); got != want {
+					t.Errorf("reopened as\n%s\nwant\n%s", got, want)
+				}
+			}
+		})
+	}
+}
+
+// dumpStore describes the users and chirps in s, deleted chirps included.
+func dumpStore(t *testing.T, s Store) string {
+	t.Helper()
+	lines := []string{}
+	err := s.View(func(tx *Tx) error {
+		for _, user := range tx.data.Users {
+			lines = append(lines, fmt.Sprintf("user %d %s %s", user.Id, user.Email, user.CreatedAt.UTC()))
+		}
+		for _, chirp := range tx.data.Chirps {
+			lines = append(lines, fmt.Sprintf("chirp %d %q %d %s %v", chirp.Id, chirp.Body, chirp.AuthorID, chirp.CreatedAt.UTC(), chirp.DeletedAt != nil))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
@@ -0,0 +1,104 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Keyring holds the AES-256 keys used to encrypt the database at rest. New
+// data is sealed with the active key; the other keys are kept only so data
+// written before a key rotation can still be read.
+//
+// Each sealed value records the ID of its key, and the ID is passed to
+// AES-GCM as additional data, so a value can't be made to decrypt under a
+// different key ID than the one it was written with.
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// cipherName is recorded in snapshot headers next to the key ID.
+const cipherName = "aes-256-gcm"
+
+// ParseKeyring reads a comma-separated list of keyID:key pairs, where each
+// key is 32 bytes of standard base64. The first pair is the active key:
+//
+//	2024-10:q8Jb...=,2024-04:Zm9v...=
+//
+// An empty spec returns a nil Keyring, which means no encryption.
+func ParseKeyring(spec string) (*Keyring, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	keyring := Keyring{keys: make(map[string]cipher.AEAD)}
+	for _, pair := range strings.Split(spec, ",") {
+		keyID, encoded, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found || keyID == "" {
+			return nil, fmt.Errorf("Encryption key %q is not in keyID:key form", pair)
+		}
+		if _, exists := keyring.keys[keyID]; exists {
+			return nil, fmt.Errorf("Encryption key ID %q is listed twice", keyID)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("Encryption key %q must be 32 bytes of base64", keyID)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys[keyID] = aead
+		if keyring.active == "" {
+			keyring.active = keyID
+		}
+	}
+	return &keyring, nil
+}
+
+// ActiveKeyID is the ID of the key new data is encrypted with.
+func (k *Keyring) ActiveKeyID() string {
+	return k.active
+}
+
+// seal encrypts plaintext with the active key. The nonce is prepended to the
+// result.
+func (k *Keyring) seal(plaintext []byte) (keyID string, sealed []byte, err error) {
+	aead := k.keys[k.active]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", nil, err
+	}
+	return k.active, aead.Seal(nonce, nonce, plaintext, []byte(k.active)), nil
+}
+
+// open decrypts a value sealed under keyID. k may be nil, in which case
+// every key is missing.
+func (k *Keyring) open(keyID string, sealed []byte) ([]byte, error) {
+	if k == nil {
+		return nil, fmt.Errorf("Data is encrypted with key %q but no keys are configured: %w", keyID, ErrKey)
+	}
+	aead, found := k.keys[keyID]
+	if !found {
+		return nil, fmt.Errorf("Data is encrypted with unknown key %q: %w", keyID, ErrKey)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, corruptError("Encrypted data is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(keyID))
+	if err != nil {
+		// Callers check a checksum of the ciphertext first, so a failure
+		// here almost always means the key itself is wrong.
+		return nil, fmt.Errorf("Couldn't decrypt data with key %q: %w", keyID, ErrKey)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testKeyring builds a Keyring from the given key IDs, the first one
+// active. Each ID always gets the same key, so a test can build the ring
+// again in a different order to rotate it.
+func testKeyring(t *testing.T, keyIDs ...string) *Keyring {
+	t.Helper()
+	pairs := []string{}
+	for _, keyID := range keyIDs {
+		key := bytes.Repeat([]byte(keyID), 32)[:32]
+		pairs = append(pairs, keyID+":"+base64.StdEncoding.EncodeToString(key))
+	}
+	keys, err := ParseKeyring(strings.Join(pairs, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// openTestDBWith opens the DB at path with opts and closes it when the test
+// ends.
+func openTestDBWith(t *testing.T, path string, opts Options) *DB {
+	t.Helper()
+	db, err := NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// assertNoPlaintext fails if any of the DB's files hold an email address
+// in the clear.
+func assertNoPlaintext(t *testing.T, path string) {
+	t.Helper()
+	for _, name := range []string{path, path + ".bak", path + ".journal"} {
+		raw, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, []byte("@example.com")) {
+			t.Errorf("%s holds plaintext", filepath.Base(name))
+		}
+	}
+}
+
+func TestEncryptedDBReopens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	keys := testKeyring(t, "k1")
+	db := openTestDBWith(t, path, Options{Keys: keys})
+	createTestUsers(t, db, 2)
+	err := db.Rewrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// This user is only in the journal.
+	createTestUsers(t, db, 1)
+	crash(db)
+	assertNoPlaintext(t, path)
+
+	reopened := openTestDBWith(t, path, Options{Keys: keys})
+	if got := countUsers(t, reopened); got != 3 {
+		t.Errorf("got %d users, want 3", got)
+	}
+}
+
+func TestEncryptedDBNeedsKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDBWith(t, path, Options{})
+	createTestUsers(t, db, 1)
+	err := db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing compacts once, leaving the plaintext snapshot as the backup.
+	db = openTestDBWith(t, path, Options{Keys: testKeyring(t, "k1")})
+	createTestUsers(t, db, 1)
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keys := range []*Keyring{nil, testKeyring(t, "k2")} {
+		_, err = NewDB(path, Options{Keys: keys})
+		if !errors.Is(err, ErrKey) {
+			t.Errorf("got %v, want ErrKey rather than the plaintext backup", err)
+		}
+	}
+	quarantined, err := filepath.Glob(path + ".corrupt-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 0 {
+		t.Errorf("got %d quarantined snapshots, want none", len(quarantined))
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDBWith(t, path, Options{Keys: testKeyring(t, "old")})
+	createTestUsers(t, db, 2)
+	err := db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key is active and the old one still reads the existing files.
+	rotated := testKeyring(t, "new", "old")
+	db = openTestDBWith(t, path, Options{Keys: rotated})
+	createTestUsers(t, db, 1)
+	crash(db)
+	db = openTestDBWith(t, path, Options{Keys: rotated})
+	if got := countUsers(t, db); got != 3 {
+		t.Fatalf("got %d users with both keys, want 3", got)
+	}
+	err = db.Rewrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestUsers(t, db, 1)
+	crash(db)
+	assertNoPlaintext(t, path)
+
+	// After Rewrite nothing on disk needs the old key.
+	_, err = NewDB(path, Options{Keys: testKeyring(t, "old")})
+	if !errors.Is(err, ErrKey) {
+		t.Errorf("got %v with only the old key, want ErrKey", err)
+	}
+	db = openTestDBWith(t, path, Options{Keys: testKeyring(t, "new")})
+	if got := countUsers(t, db); got != 4 {
+		t.Errorf("got %d users with only the new key, want 4", got)
+	}
+}
+
+func TestRewriteEncryptsPlaintextDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDBWith(t, path, Options{})
+	createTestUsers(t, db, 2)
+	err := db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := testKeyring(t, "k1")
+	db = openTestDBWith(t, path, Options{Keys: keys})
+	err = db.Rewrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestUsers(t, db, 1)
+	crash(db)
+	assertNoPlaintext(t, path)
+	if got := countUsers(t, openTestDBWith(t, path, Options{Keys: keys})); got != 3 {
+		t.Errorf("got %d users, want 3", got)
+	}
+}
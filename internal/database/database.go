@@ -1,301 +1,488 @@
 package database
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"os"
-	"runtime/debug"
 	"sync"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
+// DB is the JSON-file Store. The data lives in memory; every Update is
+// appended to a journal next to the snapshot file and the snapshot is
+// rewritten every snapshotEvery records. A single DB should be created at
+// startup and shared by the whole process.
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	txStore
+	*EventBus
+	path    string
+	opts    Options
+	mux     *sync.RWMutex
+	lock    *fileLock
+	data    DBStructure
+	journal *journal
+	// snapshot identifies the snapshot file data was loaded from, so a
+	// compaction by another process can be noticed.
+	snapshot os.FileInfo
+}
+
+// Options configure a DB or MemStore. The zero value is the default setup.
+type Options struct {
+	// IDs picks how new chirp and user IDs are allocated.
+	IDs IDScheme
+	// Keys, if set, encrypts the snapshot, journal and backups of a DB.
+	Keys *Keyring
+	// Codec encodes snapshots and backups. Nil means JSONCodec.
+	Codec Codec
+}
+
+func (opts Options) codec() Codec {
+	if opts.Codec == nil {
+		return JSONCodec
+	}
+	return opts.Codec
 }
 
+// snapshotEvery is how many journal records are written before the journal
+// is compacted into a new snapshot.
+const snapshotEvery = 1000
+
+// Chirps and users carry server-assigned timestamps and a version. CreatedAt
+// is set when the record is created; UpdatedAt and Version change every
+// time it is written. Version starts at 1, and is 0 only for records that
+// haven't been written since versions were added.
 type Chirp struct {
-	Id       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorID int    `json:"author_id"`
+	Id        int       `json:"id"`
+	Version   int       `json:"version"`
+	Body      string    `json:"body"`
+	AuthorID  int       `json:"author_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// DeletedAt is set when the chirp is soft-deleted. Deleted chirps are
+	// left out of the indexes, so queries and searches don't see them, but
+	// stay stored until purged.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type User struct {
 	Id          int    `json:"id"`
+	Version     int    `json:"version"`
 	Email       string `json:"email"`
 	Password    []byte
-	IsChirpyRed bool `json:"is_chirpy_red"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
 }
 
 type UserDTO struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Id          int       `json:"id"`
+	Email       string    `json:"email"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
 }
 
 type DBStructure struct {
-	Chirps        map[int]Chirp           `json:"chirps"`
-	Users         map[int]User            `json:"users"`
+	// Version is the schema version, see migrations.
+	Version int           `json:"version"`
+	Chirps  map[int]Chirp `json:"chirps"`
+	Users   map[int]User  `json:"users"`
+	// RefreshTokens are keyed by TokenHash.
 	RefreshTokens map[string]RefreshToken `json:"refresh_tokens"`
+	// NextChirpID and NextUserID are the lowest IDs not yet handed out.
+	NextChirpID int `json:"next_chirp_id"`
+	NextUserID  int `json:"next_user_id"`
+	// JournalSeq is the sequence number of the last journal record already
+	// folded into this snapshot.
+	JournalSeq int64 `json:"journal_seq"`
+	// EventSeq is the sequence number of the last event the data produced.
+	EventSeq int64 `json:"event_seq"`
+
+	idx *indexes
+	// pending holds events queued by changes that haven't been published.
+	pending []Event
 }
 
+// RefreshToken is a refresh token. Only its SHA-256 hash is stored, so the
+// token itself, which only the client holds, can't be read from the
+// database files.
+//
+// Each use rotates it: the token is marked RotatedAt and replaced by a new
+// one in the same family, the chain of tokens descending from one login. A
+// rotated token is kept only so that presenting it again, which means it
+// was copied, can be caught.
 type RefreshToken struct {
-	UserID    int       `json:"user_id"`
-	Token     string    `json"refresh_token:"`
+	UserID int `json:"user_id"`
+	// Token is the token itself, which was stored before schema version 4.
+	// It is always empty now; see TokenHash.
+	Token     string    `json:"refresh_token,omitempty"`
+	TokenHash string    `json:"token_hash"`
 	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// LastUsedAt is when the token was last presented.
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	// UserAgent and IP describe the client the token was issued to.
+	UserAgent string `json:"user_agent,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	// FamilyID is shared by every token in a family. Tokens issued before
+	// rotation have none and are a family of their own.
+	FamilyID  string     `json:"family_id,omitempty"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
 }
 
-func NewDB(path string) (*DB, error) {
-	defaultStructure, err := json.Marshal(DBStructure{Chirps: make(map[int]Chirp), Users: make(map[int]User), RefreshTokens: make(map[string]RefreshToken)})
+// Family returns the ID of the family token belongs to.
+func (token RefreshToken) Family() string {
+	if token.FamilyID == "" {
+		return token.TokenHash
+	}
+	return token.FamilyID
+}
+
+// HashRefreshToken returns the hash a refresh token is stored under.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newDBStructure() DBStructure {
+	dbStructure := DBStructure{Version: SchemaVersion, Chirps: make(map[int]Chirp), Users: make(map[int]User), RefreshTokens: make(map[string]RefreshToken), NextChirpID: 1, NextUserID: 1}
+	dbStructure.buildIndexes()
+	return dbStructure
+}
+
+// NewDB opens the database at path, creating it if needed, and rebuilds the
+// current state from the snapshot and any journal records written after it.
+//
+// Several processes may open the same path: every View and Update takes an
+// advisory lock on path+".lock" and first catches up with records other
+// processes have appended.
+func NewDB(path string, opts Options) (*DB, error) {
+	mux := sync.RWMutex{}
+	db := DB{path: path, opts: opts, mux: &mux, EventBus: newEventBus(0)}
+	db.txStore = txStore{view: db.View, update: db.Update}
+	lock, err := openFileLock(path + ".lock")
 	if err != nil {
-		debug.PrintStack()
-		log.Fatal()
+		return nil, ioError("Opening lock file", err)
 	}
-	_, err = os.Stat(path)
+	db.lock = lock
+	err = db.lock.lock()
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			os.WriteFile(path, defaultStructure, 0666)
-		} else {
-			log.Fatal(err)
-		}
+		db.lock.close()
+		return nil, ioError("Locking database", err)
 	}
-	mux := sync.RWMutex{}
-	db := DB{path: path, mux: &mux}
+	defer db.lock.unlock()
+	err = db.ensureDB()
+	if err == nil {
+		err = db.reload(true)
+	}
+	if err != nil {
+		db.lock.close()
+		return nil, err
+	}
+	db.publish()
 
 	return &db, nil
 }
 
-func (db *DB) loadDB() (DBStructure, error) {
-	err := db.ensureDB()
+// reload rebuilds db.data from the files on disk and brings it up to the
+// current schema version. When opening, a damaged snapshot is replaced from
+// the backup and a migrated one is rewritten straight away; that is only
+// done then, since it rewrites files other processes may be reading. The
+// caller must hold db.mux and the exclusive file lock.
+func (db *DB) reload(opening bool) error {
+	if db.journal != nil {
+		db.journal.close()
+		db.journal = nil
+	}
+	data, snapshot, recovered, err := db.loadDB()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-
-	db.mux.RLock()
-	defer db.mux.RUnlock()
-	rawFileData, err := os.ReadFile(db.path)
+	if recovered && !opening {
+		return corruptError("Snapshot %s is damaged; restart to recover from the backup", db.path)
+	}
+	db.data = data
+	db.snapshot = snapshot
+	if recovered {
+		err = db.quarantine(db.path)
+		if err != nil {
+			return err
+		}
+	}
+	db.journal, err = openJournal(db.journalPath(), db.opts.Keys)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	err = db.journal.replay(&db.data)
+	if errors.Is(err, errJournalGap) && recovered {
+		// The journal continues a newer snapshot than the backup, so its
+		// records can't be applied. Set it aside rather than guess.
+		log.Printf("%v. Discarding journal records newer than the backup", err)
+		db.journal.close()
+		err = db.quarantine(db.journalPath())
+		if err == nil {
+			db.journal, err = openJournal(db.journalPath(), db.opts.Keys)
+		}
+		if err == nil {
+			db.journal.seq = db.data.JournalSeq
+		}
 	}
-	dbStructure := DBStructure{}
-	json.Unmarshal(rawFileData, &dbStructure)
-	return dbStructure, nil
-}
-
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	marshalledDB, err := json.Marshal(dbStructure)
 	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
+		return err
 	}
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	err = os.WriteFile(db.path, marshalledDB, 0666)
+	reports, err := migrate(&db.data)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	logMigrations(db.path, reports)
+	if recovered || (opening && len(reports) > 0) {
+		// Write a good snapshot straight away so the next start doesn't
+		// depend on the backup or have to migrate again.
+		return db.compact()
 	}
 	return nil
 }
 
-func (db *DB) ensureDB() error {
-	_, err := os.Stat(db.path)
+// sync catches db.data up with changes other processes have made since it
+// was loaded. A new snapshot file means another process compacted the
+// journal, so everything is reloaded; otherwise only the journal records
+// past what this process has already read are applied. The caller must hold
+// db.mux for writing and the file lock.
+func (db *DB) sync() error {
+	snapshot, err := os.Stat(db.path)
+	if err != nil || db.journal == nil || !os.SameFile(snapshot, db.snapshot) {
+		return db.reload(false)
+	}
+	changed, err := db.journal.changed(db.journalPath())
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			NewDB(db.path)
-		} else {
-			log.Fatal(err)
-		}
+		return err
 	}
-	return nil
+	if !changed {
+		return nil
+	}
+	err = db.journal.catchUp(&db.data)
+	if errors.Is(err, errJournalGap) || errors.Is(err, errJournalReplaced) {
+		return db.reload(false)
+	}
+	return err
 }
 
-func (dbStructure *DBStructure) getMaxChirpID() int {
-	maxID := 0
-	for key, _ := range dbStructure.Chirps {
-		if key > maxID {
-			maxID = key
-		}
-	}
-	return maxID
+// publish sends the events queued by changes that are now on disk. The
+// caller must hold db.mux for writing, so events go out in commit order.
+func (db *DB) publish() {
+	pending := db.data.pending
+	db.data.pending = nil
+	// Events before these were never seen if a reload jumped ahead.
+	db.EventBus.skipTo(db.data.EventSeq - int64(len(pending)))
+	db.EventBus.publish(pending)
 }
 
-func (dbStructure *DBStructure) getMaxUserID() int {
-	maxID := 0
-	for key, _ := range dbStructure.Users {
-		if key > maxID {
-			maxID = key
-		}
+// quarantine moves a damaged file out of the way, keeping it for inspection.
+func (db *DB) quarantine(path string) error {
+	err := os.Rename(path, fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix()))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return ioError("Moving damaged file aside", err)
 	}
-	return maxID
+	return nil
 }
 
-func (db *DB) CreateChirp(body string, userID int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		log.Fatal(err)
-	}
-	id := dbStructure.getMaxChirpID() + 1
-	chirp := Chirp{Id: id, Body: body, AuthorID: userID}
-	dbStructure.Chirps[id] = chirp
-	err = db.writeDB(dbStructure)
+// View runs fn with a read-only transaction. Concurrent View calls may run
+// in parallel, but never alongside an Update.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	err := db.refresh()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	return chirp, nil
-
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return fn(&Tx{data: &db.data})
 }
 
-func (db *DB) GetChirps() ([]Chirp, error) {
-	chirps := []Chirp{}
-	dbStructure, err := db.loadDB()
+// refresh runs sync under a shared file lock, so a View sees everything
+// committed by other processes before it started.
+func (db *DB) refresh() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	err := db.lock.rlock()
 	if err != nil {
-		log.Fatal(err)
-	}
-	for _, v := range dbStructure.Chirps {
-		chirps = append(chirps, v)
+		return ioError("Locking database", err)
 	}
-	return chirps, nil
+	defer db.lock.unlock()
+	err = db.sync()
+	db.publish()
+	return err
 }
 
-func (db *DB) GetChirpByID(chirpID int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
+// Update runs fn with a writable transaction while holding the write lock
+// and the exclusive file lock. If fn succeeds its changes are appended to
+// the journal as one record, otherwise they are undone, so a
+// read-modify-write done inside fn is atomic with respect to every other
+// View and Update, in this process or another.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	err := db.lock.lock()
 	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
+		return ioError("Locking database", err)
 	}
-	chirp, ok := dbStructure.Chirps[chirpID]
-	if ok {
-		return chirp, nil
+	defer db.lock.unlock()
+	err = db.sync()
+	db.publish()
+	if err != nil {
+		return err
 	}
-	return Chirp{}, errors.New("Chirp not found")
-
-}
-
-func (db *DB) DeleteChirpByID(chirpID int) error {
-	dbStructure, err := db.loadDB()
+	tx := Tx{data: &db.data, writable: true, ids: db.opts.IDs}
+	err = fn(&tx)
 	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
+		tx.rollback()
+		return err
 	}
-	delete(dbStructure.Chirps, chirpID)
-	err = db.writeDB(dbStructure)
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	err = db.journal.append(tx.ops)
 	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
+		tx.rollback()
+		return err
+	}
+	db.publish()
+	if db.journal.records >= snapshotEvery {
+		err = db.compact()
+		if err != nil {
+			// The journal still holds every record, so nothing is lost; the
+			// next Update will try again.
+			log.Println("Couldn't compact journal:", err)
+		}
 	}
 	return nil
 }
 
-func (db *DB) CreateUser(email string, password string) (User, error) {
-	dbStructure, err := db.loadDB()
+// Close writes a final snapshot and closes the journal.
+func (db *DB) Close() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	defer db.lock.close()
+	err := db.lock.lock()
 	if err != nil {
-		log.Fatal(err)
+		return ioError("Locking database", err)
 	}
-	_, err = db.GetUserByEmail(email)
+	defer db.lock.unlock()
+	err = db.sync()
 	if err == nil {
-		return User{}, errors.New("User with this email already exists")
-	}
-	id := dbStructure.getMaxUserID() + 1
-	hashedPass, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		debug.PrintStack()
-		log.Fatal()
+		err = db.compact()
 	}
-	user := User{Id: id, Email: email, Password: hashedPass}
-	dbStructure.Users[id] = user
-	err = db.writeDB(dbStructure)
 	if err != nil {
-		log.Fatal(err)
+		db.journal.close()
+		return err
 	}
-	return user, nil
+	return db.journal.close()
 }
 
-func (db *DB) GetUsers() ([]User, error) {
-	users := []User{}
-	dbStructure, err := db.loadDB()
+// compact folds the journal into a new snapshot and empties it. A crash
+// between the two steps is harmless: replay skips records the snapshot
+// already contains. The caller must hold db.mux and the exclusive file lock.
+func (db *DB) compact() error {
+	db.data.JournalSeq = db.journal.seq
+	err := db.writeDB(db.data)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	for _, v := range dbStructure.Users {
-		users = append(users, v)
+	db.snapshot, err = os.Stat(db.path)
+	if err != nil {
+		return ioError("Writing snapshot", err)
 	}
-	return users, nil
+	return db.journal.truncate()
 }
 
-func (db *DB) GetUserByID(userID int) (User, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
+// loadDB reads the snapshot file, falling back to the backup kept by writeDB
+// if the snapshot is missing or damaged. recovered reports whether the
+// backup was used, and info identifies the file that was read.
+func (db *DB) loadDB() (dbStructure DBStructure, info os.FileInfo, recovered bool, err error) {
+	dbStructure, info, err = readSnapshot(db.path, db.opts.Keys)
+	if err == nil {
+		return dbStructure, info, false, nil
 	}
-	user, ok := dbStructure.Users[userID]
-	if ok {
-		return user, nil
+	if errors.Is(err, ErrKey) {
+		// The snapshot is fine; falling back to an older backup would
+		// quietly lose data.
+		return DBStructure{}, nil, false, err
 	}
-	return User{}, errors.New("User not found")
-
+	backup, info, backupErr := readSnapshot(db.backupPath(), db.opts.Keys)
+	if backupErr != nil {
+		return DBStructure{}, nil, false, fmt.Errorf("Couldn't load %s: %w (backup unusable: %v)", db.path, err, backupErr)
+	}
+	log.Printf("Couldn't load %s: %v. Recovering from %s", db.path, err, db.backupPath())
+	return backup, info, true, nil
 }
 
-func (db *DB) GetUserByEmail(email string) (User, error) {
-	dbStructure, err := db.loadDB()
+// writeDB atomically replaces the snapshot file, keeping the previous one as
+// a backup.
+func (db *DB) writeDB(dbStructure DBStructure) error {
+	raw, err := encodeSnapshot(dbStructure, db.opts)
 	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
+		return err
 	}
-	for _, v := range dbStructure.Users {
-		if v.Email == email {
-			return v, nil
+	_, err = os.Stat(db.path)
+	if err == nil {
+		err = os.Remove(db.backupPath())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return ioError("Rotating backup", err)
+		}
+		err = os.Link(db.path, db.backupPath())
+		if err != nil {
+			return ioError("Rotating backup", err)
 		}
 	}
-	return User{}, errors.New("User not found")
+	return ioError("Writing snapshot", writeFileAtomic(db.path, raw))
 }
 
-func (db *DB) UpdateUser(user User) (User, error) {
-	dbStructure, err := db.loadDB()
+// Rewrite rewrites the snapshot, its backup and the journal with the
+// current Options: the active key, or plaintext if no keys are configured,
+// and the configured codec. Run it after turning on encryption, rotating
+// keys or switching codecs, so no file on disk depends on the old setting.
+func (db *DB) Rewrite() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	err := db.lock.lock()
 	if err != nil {
-		fmt.Println(err)
-		return User{}, errors.New("Couldn't load db")
+		return ioError("Locking database", err)
 	}
-	dbStructure.Users[user.Id] = user
-	newUser := dbStructure.Users[user.Id]
-	db.writeDB(dbStructure)
-	return newUser, nil
-}
-
-func (db *DB) CreateRefreshToken(rToken RefreshToken) (RefreshToken, error) {
-	dbStructure, err := db.loadDB()
+	defer db.lock.unlock()
+	err = db.sync()
 	if err != nil {
-		fmt.Println(err)
-		return RefreshToken{}, errors.New("Couldn't load db")
+		return err
 	}
-	dbStructure.RefreshTokens[rToken.Token] = rToken
-	db.writeDB(dbStructure)
-	return rToken, nil
-}
-
-func (db *DB) GetRefreshToken(token string) (RefreshToken, error) {
-	dbStructure, err := db.loadDB()
+	// writeDB keeps the previous snapshot as the backup, so the second
+	// compaction replaces the old backup with a rewritten one too.
+	err = db.compact()
 	if err != nil {
-		log.Fatal("Couldn't load db")
-	}
-	if rToken, ok := dbStructure.RefreshTokens[token]; ok {
-		return rToken, nil
+		return err
 	}
-	return RefreshToken{}, errors.New("Refresh token not found")
+	return db.compact()
+}
 
+func (db *DB) backupPath() string {
+	return db.path + ".bak"
 }
 
-func (db *DB) DeleteRefreshToken(token string) error {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		log.Fatal("Couldn't load db")
-	}
-	delete(dbStructure.RefreshTokens, token)
-	db.writeDB(dbStructure)
-	return nil
+func (db *DB) journalPath() string {
+	return db.path + ".journal"
+}
 
+// ensureDB creates an empty database if there is neither a snapshot nor a
+// backup to recover from.
+func (db *DB) ensureDB() error {
+	for _, path := range []string{db.path, db.backupPath()} {
+		_, err := os.Stat(path)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return ioError("Opening database", err)
+		}
+	}
+	return db.writeDB(newDBStructure())
 }
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// damage flips a byte in the middle of the file at path.
+func damage(t *testing.T, path string) {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)/2] ^= 0x01
+	err = os.WriteFile(path, raw, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadDBRecoversFromBackup(t *testing.T) {
+	db, path := openTestDB(t)
+	createTestUsers(t, db, 2)
+	// Rewrite compacts twice, so the backup holds both users too.
+	err := db.Rewrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	damage(t, path)
+
+	reopened := reopenTestDB(t, path)
+	if got := countUsers(t, reopened); got != 2 {
+		t.Errorf("got %d users after recovery, want 2", got)
+	}
+	quarantined, err := filepath.Glob(path + ".corrupt-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 1 {
+		t.Errorf("got %d quarantined snapshots, want 1", len(quarantined))
+	}
+	// Recovery writes a good snapshot straight away.
+	_, _, err = readSnapshot(path, nil)
+	if err != nil {
+		t.Errorf("snapshot after recovery: %v", err)
+	}
+}
+
+func TestLoadDBFailsWithoutUsableBackup(t *testing.T) {
+	db, path := openTestDB(t)
+	createTestUsers(t, db, 1)
+	err := db.Rewrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	damage(t, path)
+	damage(t, path+".bak")
+
+	_, err = NewDB(path, Options{})
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("got %v, want ErrCorrupt", err)
+	}
+}
@@ -0,0 +1,43 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by Store methods are wrapped around one of these, with
+// context added, so callers can tell them apart with errors.Is.
+var (
+	// ErrNotFound means the requested chirp, user or token doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrGone means the chirp was deleted. It can still be restored within
+	// the undelete window.
+	ErrGone = errors.New("deleted")
+	// ErrConflict means the write would clash with existing data, such as a
+	// second user with the same email.
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidQuery means a query's parameters or cursor are malformed.
+	ErrInvalidQuery = errors.New("invalid query")
+	// ErrCorrupt means a database file failed its checksum or couldn't be
+	// parsed.
+	ErrCorrupt = errors.New("database is corrupt")
+	// ErrKey means a database file is encrypted with a key that isn't
+	// configured, or the configured key is wrong.
+	ErrKey = errors.New("encryption key missing or wrong")
+	// ErrIO means reading or writing a database file failed.
+	ErrIO = errors.New("database I/O failed")
+)
+
+// ioError wraps err, which came from the file system while doing what, in
+// ErrIO. The original error stays reachable through errors.Is and As.
+func ioError(what string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %w: %w", what, ErrIO, err)
+}
+
+// corruptError describes damage found in a database file.
+func corruptError(format string, a ...any) error {
+	return fmt.Errorf("%s: %w", fmt.Sprintf(format, a...), ErrCorrupt)
+}
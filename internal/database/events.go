@@ -0,0 +1,230 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+type EventType string
+
+const (
+	EventChirpCreated  EventType = "chirp_created"
+	EventChirpDeleted  EventType = "chirp_deleted"
+	EventChirpRestored EventType = "chirp_restored"
+	EventUserCreated   EventType = "user_created"
+	EventUserUpdated   EventType = "user_updated"
+	EventUserUpgraded  EventType = "user_upgraded"
+	EventTokenRevoked  EventType = "token_revoked"
+)
+
+// Event describes one committed change. Seq numbers the events of a
+// database one after another, so a subscriber that sees a jump knows it
+// missed some.
+type Event struct {
+	Seq  int64     `json:"seq"`
+	Type EventType `json:"type"`
+	// Chirp is set for chirp events and User for user events. For
+	// TokenRevoked only UserID is set, so tokens never leave the database.
+	Chirp  *Chirp   `json:"chirp,omitempty"`
+	User   *UserDTO `json:"user,omitempty"`
+	UserID int      `json:"user_id,omitempty"`
+}
+
+// ErrEventsExpired means a subscriber asked to resume from a sequence
+// number older than the events still held in memory.
+var ErrEventsExpired = errors.New("events no longer available")
+
+// ErrLagged is reported by Subscription.Err when a subscriber fell so far
+// behind that it was dropped. It can subscribe again from the last Seq it
+// saw.
+var ErrLagged = errors.New("subscriber fell behind")
+
+// eventsFor returns the events caused by o, given undo, the op that reverses
+// it, which tells what o replaced.
+func eventsFor(o op, undo op) []Event {
+	switch o.Kind {
+	case opPutChirp:
+		chirp := *o.Chirp
+		switch {
+		case undo.Kind == opDeleteChirp:
+			return []Event{{Type: EventChirpCreated, Chirp: &chirp}}
+		case undo.Chirp.DeletedAt == nil && chirp.DeletedAt != nil:
+			return []Event{{Type: EventChirpDeleted, Chirp: &chirp}}
+		case undo.Chirp.DeletedAt != nil && chirp.DeletedAt == nil:
+			return []Event{{Type: EventChirpRestored, Chirp: &chirp}}
+		}
+	case opDeleteChirp:
+		// Purging a chirp that was already soft-deleted isn't news.
+		if undo.Chirp != nil && undo.Chirp.DeletedAt == nil {
+			return []Event{{Type: EventChirpDeleted, Chirp: undo.Chirp}}
+		}
+	case opPutUser:
+		user := userDTO(*o.User)
+		switch {
+		case undo.Kind == opDeleteUser:
+			return []Event{{Type: EventUserCreated, User: &user}}
+		case !undo.User.IsChirpyRed && user.IsChirpyRed:
+			return []Event{{Type: EventUserUpgraded, User: &user}}
+		default:
+			return []Event{{Type: EventUserUpdated, User: &user}}
+		}
+	case opDeleteToken:
+		// A rotated or expired token was already unusable.
+		if undo.Token != nil && undo.Token.RotatedAt == nil && !o.Expired {
+			return []Event{{Type: EventTokenRevoked, UserID: undo.Token.UserID}}
+		}
+	}
+	return nil
+}
+
+func userDTO(user User) UserDTO {
+	return UserDTO{Id: user.Id, Email: user.Email, IsChirpyRed: user.IsChirpyRed, CreatedAt: user.CreatedAt, UpdatedAt: user.UpdatedAt}
+}
+
+// applyLogged is apply for changes being committed: it also numbers and
+// queues the events o causes, to be published once the commit is durable.
+// Events are derived from ops, so replaying the journal gives the same
+// events with the same numbers.
+func (dbStructure *DBStructure) applyLogged(o op) (undo op, events int) {
+	undo = dbStructure.apply(o)
+	for _, event := range eventsFor(o, undo) {
+		dbStructure.EventSeq++
+		event.Seq = dbStructure.EventSeq
+		dbStructure.pending = append(dbStructure.pending, event)
+		events++
+	}
+	return undo, events
+}
+
+// eventHistory is how many recent events an EventBus keeps for subscribers
+// resuming from an earlier sequence number.
+const eventHistory = 4096
+
+// subscriberBuffer is how many events a subscriber may fall behind by
+// before it is dropped.
+const subscriberBuffer = eventHistory + 1024
+
+// EventBus delivers committed events to subscribers, in order. DB and
+// MemStore each own one and publish to it after every commit, including
+// commits by other processes that a DB catches up with.
+type EventBus struct {
+	mux     sync.Mutex
+	lastSeq int64
+	history []Event
+	subs    map[*Subscription]struct{}
+}
+
+func newEventBus(lastSeq int64) *EventBus {
+	return &EventBus{lastSeq: lastSeq, subs: make(map[*Subscription]struct{})}
+}
+
+// Subscription is a stream of events. Events is closed when the
+// subscription ends; Err then says why.
+type Subscription struct {
+	Events <-chan Event
+	events chan Event
+	bus    *EventBus
+	err    error
+}
+
+// Subscribe returns the events after sequence number after, starting with
+// any that were already published. Pass LastEventSeq to get only new
+// events. Only recent events are kept in memory, and none from before the
+// process started other than those in the journal; resuming from further
+// back fails with ErrEventsExpired.
+func (b *EventBus) Subscribe(after int64) (*Subscription, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if after < 0 || after > b.lastSeq {
+		return nil, fmt.Errorf("No event has sequence number %d: %w", after, ErrInvalidQuery)
+	}
+	oldest := b.lastSeq + 1
+	if len(b.history) > 0 {
+		oldest = b.history[0].Seq
+	}
+	if after+1 < oldest {
+		return nil, fmt.Errorf("Oldest event held is %d: %w", oldest, ErrEventsExpired)
+	}
+	events := make(chan Event, subscriberBuffer)
+	for _, event := range b.history {
+		if event.Seq > after {
+			events <- event
+		}
+	}
+	s := &Subscription{Events: events, events: events, bus: b}
+	b.subs[s] = struct{}{}
+	return s, nil
+}
+
+// LastEventSeq is the sequence number of the latest event published.
+func (b *EventBus) LastEventSeq() int64 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.lastSeq
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.bus.mux.Lock()
+	defer s.bus.mux.Unlock()
+	s.bus.drop(s, nil)
+}
+
+// Err is why Events was closed: nil after Close, ErrLagged if the
+// subscriber was too slow.
+func (s *Subscription) Err() error {
+	s.bus.mux.Lock()
+	defer s.bus.mux.Unlock()
+	return s.err
+}
+
+// drop ends s. The caller must hold b.mux.
+func (b *EventBus) drop(s *Subscription, err error) {
+	if _, ok := b.subs[s]; !ok {
+		return
+	}
+	delete(b.subs, s)
+	s.err = err
+	close(s.events)
+}
+
+// publish hands events to every subscriber. It never blocks: a subscriber
+// whose buffer is full is dropped with ErrLagged instead of holding up the
+// database.
+func (b *EventBus) publish(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for _, event := range events {
+		if event.Seq <= b.lastSeq {
+			continue
+		}
+		b.lastSeq = event.Seq
+		b.history = append(b.history, event)
+		for s := range b.subs {
+			select {
+			case s.events <- event:
+			default:
+				b.drop(s, ErrLagged)
+			}
+		}
+	}
+	if len(b.history) > eventHistory {
+		b.history = append([]Event(nil), b.history[len(b.history)-eventHistory:]...)
+	}
+}
+
+// skipTo records that events up to seq happened without being seen, as when
+// a DB reloads a snapshot written by another process. Subscribers see the
+// jump in Seq; resuming from before it fails with ErrEventsExpired.
+func (b *EventBus) skipTo(seq int64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if seq > b.lastSeq {
+		b.lastSeq = seq
+		b.history = nil
+	}
+}
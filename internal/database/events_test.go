@@ -0,0 +1,194 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// nextEvent waits for the next event on sub.
+func nextEvent(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+	select {
+	case event, ok := <-sub.Events:
+		if !ok {
+			t.Fatalf("subscription ended: %v", sub.Err())
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event within 5s")
+	}
+	return Event{}
+}
+
+// expectEvents reads len(want) events from sub and checks their types and
+// that their sequence numbers follow on from after.
+func expectEvents(t *testing.T, sub *Subscription, after int64, want ...EventType) {
+	t.Helper()
+	for i, eventType := range want {
+		event := nextEvent(t, sub)
+		if event.Type != eventType || event.Seq != after+int64(i)+1 {
+			t.Errorf("event %d: got %s #%d, want %s #%d", i, event.Type, event.Seq, eventType, after+int64(i)+1)
+		}
+	}
+}
+
+// testEvents is a run of writes to s, followed by the events they publish.
+func testEvents(t *testing.T, s Store) []EventType {
+	t.Helper()
+	user, err := s.CreateUser("user@example.com", []byte("hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := s.CreateChirp("Hello", user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DeleteChirpByID(chirp.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UndeleteChirp(chirp.Id, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.IsChirpyRed = true
+	_, err = s.UpdateUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []EventType{EventUserCreated, EventChirpCreated, EventChirpDeleted, EventChirpRestored, EventUserUpgraded}
+}
+
+func TestEventsInOrder(t *testing.T) {
+	s := NewMemStore(Options{})
+	sub, err := s.Subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	want := testEvents(t, s)
+	expectEvents(t, sub, 0, want...)
+	if got := s.LastEventSeq(); got != int64(len(want)) {
+		t.Errorf("LastEventSeq is %d, want %d", got, len(want))
+	}
+}
+
+func TestSubscribeResumes(t *testing.T) {
+	s := NewMemStore(Options{})
+	want := testEvents(t, s)
+
+	// Events already published are replayed from after the given one.
+	sub, err := s.Subscribe(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	expectEvents(t, sub, 2, want[2:]...)
+	createTestUsers(t, s, 1)
+	expectEvents(t, sub, int64(len(want)), EventUserCreated)
+
+	_, err = s.Subscribe(s.LastEventSeq() + 1)
+	if !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("subscribing past the last event: got %v, want ErrInvalidQuery", err)
+	}
+}
+
+func TestSubscribeExpired(t *testing.T) {
+	bus := newEventBus(0)
+	events := []Event{}
+	for seq := int64(1); seq <= eventHistory+10; seq++ {
+		events = append(events, Event{Seq: seq, Type: EventUserCreated})
+	}
+	bus.publish(events)
+
+	_, err := bus.Subscribe(9)
+	if !errors.Is(err, ErrEventsExpired) {
+		t.Errorf("got %v, want ErrEventsExpired", err)
+	}
+	sub, err := bus.Subscribe(10)
+	if err != nil {
+		t.Fatalf("resuming from the oldest event held: %v", err)
+	}
+	sub.Close()
+
+	// A jump past events that were never seen expires everything before it.
+	bus.skipTo(eventHistory + 20)
+	_, err = bus.Subscribe(eventHistory + 10)
+	if !errors.Is(err, ErrEventsExpired) {
+		t.Errorf("after a skip: got %v, want ErrEventsExpired", err)
+	}
+}
+
+func TestSlowSubscriberLags(t *testing.T) {
+	bus := newEventBus(0)
+	sub, err := bus.Subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := int64(1); seq <= subscriberBuffer+1; seq++ {
+		bus.publish([]Event{{Seq: seq, Type: EventUserCreated}})
+	}
+
+	received := 0
+	for range sub.Events {
+		received++
+	}
+	if received != subscriberBuffer {
+		t.Errorf("got %d events before the drop, want %d", received, subscriberBuffer)
+	}
+	if err := sub.Err(); !errors.Is(err, ErrLagged) {
+		t.Errorf("got %v, want ErrLagged", err)
+	}
+}
+
+func TestSecondHandleCatchesUpEvents(t *testing.T) {
+	first, path := openTestDB(t)
+	second := reopenTestDB(t, path)
+	sub, err := second.Subscribe(second.LastEventSeq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	want := testEvents(t, first)
+	// The second handle publishes what it reads from the journal the next
+	// time it is used.
+	countUsers(t, second)
+	expectEvents(t, sub, 0, want...)
+}
+
+func TestPurgingExpiredTokensIsNotRevocation(t *testing.T) {
+	s := NewMemStore(Options{})
+	now := time.Now().UTC()
+	for userID, expiresAt := range map[int]time.Time{
+		1: now.Add(time.Hour),
+		2: now.Add(-time.Hour),
+	} {
+		_, err := s.CreateRefreshToken(fmt.Sprint("token", userID), RefreshToken{UserID: userID, CreatedAt: now, ExpiresAt: expiresAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sub, err := s.Subscribe(s.LastEventSeq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	purged, err := s.PurgeExpiredRefreshTokens(now)
+	if err != nil || purged != 1 {
+		t.Fatalf("purged %d tokens (%v), want 1", purged, err)
+	}
+	err = s.DeleteRefreshToken("token1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the live token's revocation is published.
+	event := nextEvent(t, sub)
+	if event.Type != EventTokenRevoked || event.Seq != 1 || event.UserID != 1 {
+		t.Errorf("got %s #%d for user %d, want token_revoked #1 for user 1", event.Type, event.Seq, event.UserID)
+	}
+}
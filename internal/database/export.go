@@ -0,0 +1,566 @@
+package database
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Format is a bulk export and import format.
+type Format string
+
+const (
+	// FormatJSONL is one JSON record per line.
+	FormatJSONL Format = "jsonl"
+	// FormatCSV is a header row naming the columns, then one record per
+	// row. Columns a record kind doesn't use are left empty.
+	FormatCSV Format = "csv"
+)
+
+// RecordKind says what a Record holds.
+type RecordKind string
+
+const (
+	RecordUser  RecordKind = "user"
+	RecordChirp RecordKind = "chirp"
+	RecordToken RecordKind = "token"
+)
+
+// Record is one user, chirp or refresh token in an export. It is flat, so
+// the same columns work for CSV, and only the fields for its Kind are set.
+// Users come first in an export, so an import has seen a chirp's author
+// before the chirp.
+type Record struct {
+	Kind RecordKind `json:"kind"`
+	// ID is the user or chirp ID in the database the record came from.
+	ID           int    `json:"id,omitempty"`
+	Email        string `json:"email,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	IsChirpyRed  bool   `json:"is_chirpy_red,omitempty"`
+	Body         string `json:"body,omitempty"`
+	AuthorID     int    `json:"author_id,omitempty"`
+	// UserID, TokenHash and ExpiresAt are set for refresh tokens. Only
+	// the hash is exported, since that is all the database has.
+	UserID    int        `json:"user_id,omitempty"`
+	TokenHash string     `json:"token_hash,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+var csvColumns = []string{"kind", "id", "email", "password_hash", "is_chirpy_red", "body", "author_id", "user_id", "token_hash", "created_at", "updated_at", "deleted_at", "expires_at"}
+
+// ExportOptions pick what an export contains.
+type ExportOptions struct {
+	Format Format
+	// Kinds limits the export to these kinds of record. Empty means all.
+	Kinds []RecordKind
+	// Passwords includes users' password hashes, which are left out by
+	// default. Without them, imported users can't log in until they are
+	// given a new password.
+	Passwords bool
+}
+
+// ImportOptions control how records are imported.
+type ImportOptions struct {
+	Format Format
+	// DryRun validates every record and reports what would be imported
+	// without changing anything.
+	DryRun bool
+	// MaxBodyLength, if set, rejects longer chirps.
+	MaxBodyLength int
+	// MergeMatchedUsers imports the chirps of users whose email already
+	// exists as chirps by the existing user. It is off by default, since
+	// otherwise anyone who can get a file imported could post as any user
+	// whose email they know. Tokens for matched users are always rejected,
+	// as a token hash of the importer's choosing would let them sign in as
+	// that user.
+	MergeMatchedUsers bool
+}
+
+// ImportReport summarises an import. Records that failed validation are
+// skipped and listed in Errors; the rest are imported.
+type ImportReport struct {
+	DryRun bool `json:"dry_run"`
+	// Users counts the users created and MatchedUsers those whose email
+	// already existed. See ImportOptions.MergeMatchedUsers for what happens
+	// to a matched user's chirps and tokens.
+	Users        int           `json:"users"`
+	MatchedUsers int           `json:"matched_users"`
+	Chirps       int           `json:"chirps"`
+	Tokens       int           `json:"tokens"`
+	Skipped      int           `json:"skipped"`
+	Errors       []ImportError `json:"errors,omitempty"`
+	// UserIDs and ChirpIDs map the IDs in the import to the new ones.
+	UserIDs  map[int]int `json:"user_ids,omitempty"`
+	ChirpIDs map[int]int `json:"chirp_ids,omitempty"`
+}
+
+// ImportError is a record that couldn't be imported. Line is where the
+// record starts in the input, counting from 1.
+type ImportError struct {
+	Line int    `json:"line"`
+	Err  string `json:"error"`
+}
+
+func (e ImportError) Error() string {
+	return fmt.Sprintf("Line %d: %s", e.Line, e.Err)
+}
+
+// errDryRun rolls back a dry-run import.
+var errDryRun = errors.New("dry run")
+
+func checkFormat(format Format) error {
+	if format != FormatJSONL && format != FormatCSV {
+		return fmt.Errorf("Unknown format %q: %w", format, ErrInvalidQuery)
+	}
+	return nil
+}
+
+// Check reports whether opts name a known format and record kinds, so a
+// caller can reject bad options before starting to write an export.
+func (opts ExportOptions) Check() error {
+	err := checkFormat(opts.Format)
+	if err != nil {
+		return err
+	}
+	for _, kind := range opts.Kinds {
+		if kind != RecordUser && kind != RecordChirp && kind != RecordToken {
+			return fmt.Errorf("Unknown record kind %q: %w", kind, ErrInvalidQuery)
+		}
+	}
+	return nil
+}
+
+// exportSnapshot is a copy of the records an export selected, taken in one
+// View. Copying a User, Chirp or RefreshToken is cheap, since its strings
+// and slices are shared with the database rather than duplicated, and
+// records are never changed in place, so the copy can be written out after
+// the View has ended.
+type exportSnapshot struct {
+	opts   ExportOptions
+	users  []User
+	chirps []Chirp
+	tokens []RefreshToken
+}
+
+// snapshotExport copies the records selected by opts: users and chirps in
+// ID order, and tokens in the order they were created. Soft-deleted chirps
+// are included.
+func (tx *Tx) snapshotExport(opts ExportOptions) (exportSnapshot, error) {
+	err := opts.Check()
+	if err != nil {
+		return exportSnapshot{}, err
+	}
+	wants := func(kind RecordKind) bool {
+		return len(opts.Kinds) == 0 || slices.Contains(opts.Kinds, kind)
+	}
+	snap := exportSnapshot{opts: opts}
+	if wants(RecordUser) {
+		snap.users = make([]User, 0, len(tx.data.Users))
+		for _, user := range tx.data.Users {
+			snap.users = append(snap.users, user)
+		}
+		slices.SortFunc(snap.users, func(a, b User) int { return a.Id - b.Id })
+	}
+	if wants(RecordChirp) {
+		snap.chirps = make([]Chirp, 0, len(tx.data.Chirps))
+		for _, chirp := range tx.data.Chirps {
+			snap.chirps = append(snap.chirps, chirp)
+		}
+		slices.SortFunc(snap.chirps, func(a, b Chirp) int { return a.Id - b.Id })
+	}
+	if wants(RecordToken) {
+		snap.tokens = make([]RefreshToken, 0, len(tx.data.RefreshTokens))
+		for _, token := range tx.data.RefreshTokens {
+			// Rotated tokens are only kept to catch reuse.
+			if token.RotatedAt == nil {
+				snap.tokens = append(snap.tokens, token)
+			}
+		}
+		slices.SortFunc(snap.tokens, func(a, b RefreshToken) int {
+			if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+				return c
+			}
+			return strings.Compare(a.TokenHash, b.TokenHash)
+		})
+	}
+	return snap, nil
+}
+
+// emit passes the records to emit one at a time: users, then chirps, then
+// tokens. It stops at the first error from emit.
+func (snap exportSnapshot) emit(emit func(Record) error) error {
+	for _, user := range snap.users {
+		record := Record{Kind: RecordUser, ID: user.Id, Email: user.Email, IsChirpyRed: user.IsChirpyRed, CreatedAt: user.CreatedAt, UpdatedAt: &user.UpdatedAt}
+		if snap.opts.Passwords {
+			record.PasswordHash = string(user.Password)
+		}
+		err := emit(record)
+		if err != nil {
+			return err
+		}
+	}
+	for _, chirp := range snap.chirps {
+		err := emit(Record{Kind: RecordChirp, ID: chirp.Id, Body: chirp.Body, AuthorID: chirp.AuthorID, CreatedAt: chirp.CreatedAt, UpdatedAt: &chirp.UpdatedAt, DeletedAt: chirp.DeletedAt})
+		if err != nil {
+			return err
+		}
+	}
+	for _, token := range snap.tokens {
+		err := emit(Record{Kind: RecordToken, UserID: token.UserID, TokenHash: token.TokenHash, CreatedAt: token.CreatedAt, ExpiresAt: &token.ExpiresAt})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportRecords passes the records selected by opts to emit one at a time:
+// users, then chirps, then tokens, each in ID order. Soft-deleted chirps are
+// included with DeletedAt set. It stops at the first error from emit.
+func (tx *Tx) ExportRecords(opts ExportOptions, emit func(Record) error) error {
+	snap, err := tx.snapshotExport(opts)
+	if err != nil {
+		return err
+	}
+	return snap.emit(emit)
+}
+
+// RecordWriter writes records to an io.Writer in one format, one at a time.
+type RecordWriter struct {
+	json *json.Encoder
+	csv  *csv.Writer
+}
+
+// NewRecordWriter starts writing records to w in format. For CSV that
+// writes the header row straight away.
+func NewRecordWriter(w io.Writer, format Format) (*RecordWriter, error) {
+	err := checkFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	if format == FormatJSONL {
+		return &RecordWriter{json: json.NewEncoder(w)}, nil
+	}
+	rw := RecordWriter{csv: csv.NewWriter(w)}
+	return &rw, rw.csv.Write(csvColumns)
+}
+
+// Write writes one record. CSV output is buffered until Flush.
+func (rw *RecordWriter) Write(record Record) error {
+	if rw.json != nil {
+		return rw.json.Encode(record)
+	}
+	return rw.csv.Write(record.csvRow())
+}
+
+// Flush writes any buffered records.
+func (rw *RecordWriter) Flush() error {
+	if rw.csv == nil {
+		return nil
+	}
+	rw.csv.Flush()
+	return rw.csv.Error()
+}
+
+func (record Record) csvRow() []string {
+	formatInt := func(n int) string {
+		if n == 0 {
+			return ""
+		}
+		return strconv.Itoa(n)
+	}
+	formatTime := func(t *time.Time) string {
+		if t == nil || t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339Nano)
+	}
+	isChirpyRed := ""
+	if record.Kind == RecordUser {
+		isChirpyRed = strconv.FormatBool(record.IsChirpyRed)
+	}
+	return []string{string(record.Kind), formatInt(record.ID), record.Email, record.PasswordHash, isChirpyRed, record.Body, formatInt(record.AuthorID), formatInt(record.UserID), record.TokenHash, formatTime(&record.CreatedAt), formatTime(record.UpdatedAt), formatTime(record.DeletedAt), formatTime(record.ExpiresAt)}
+}
+
+// numberedRecord is a record read for import, with the line it came from.
+type numberedRecord struct {
+	line   int
+	record Record
+}
+
+// readRecords reads every record from r. Lines that can't be parsed are
+// returned as errors rather than stopping the read, so an import can report
+// them all at once; only a failure to read r at all is returned as err.
+func readRecords(r io.Reader, format Format) ([]numberedRecord, []ImportError, error) {
+	err := checkFormat(format)
+	if err != nil {
+		return nil, nil, err
+	}
+	records := []numberedRecord{}
+	bad := []ImportError{}
+	if format == FormatJSONL {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		line := 0
+		for scanner.Scan() {
+			line++
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			record := Record{}
+			err := json.Unmarshal([]byte(text), &record)
+			if err != nil {
+				bad = append(bad, ImportError{Line: line, Err: err.Error()})
+				continue
+			}
+			records = append(records, numberedRecord{line, record})
+		}
+		return records, bad, scanner.Err()
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Reading CSV header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns["kind"]; !ok {
+		return nil, nil, fmt.Errorf("CSV header has no kind column: %w", ErrInvalidQuery)
+	}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				bad = append(bad, ImportError{Line: parseErr.Line, Err: parseErr.Err.Error()})
+				continue
+			}
+			return nil, nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		record, err := parseCSVRow(row, columns)
+		if err != nil {
+			bad = append(bad, ImportError{Line: line, Err: err.Error()})
+			continue
+		}
+		records = append(records, numberedRecord{line, record})
+	}
+	return records, bad, nil
+}
+
+func parseCSVRow(row []string, columns map[string]int) (Record, error) {
+	var err error
+	field := func(name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return row[i]
+	}
+	parseInt := func(name string) int {
+		value := field(name)
+		if value == "" || err != nil {
+			return 0
+		}
+		n, parseErr := strconv.Atoi(value)
+		if parseErr != nil {
+			err = fmt.Errorf("Invalid %s %q", name, value)
+		}
+		return n
+	}
+	parseTime := func(name string) *time.Time {
+		value := field(name)
+		if value == "" || err != nil {
+			return nil
+		}
+		t, parseErr := time.Parse(time.RFC3339Nano, value)
+		if parseErr != nil {
+			err = fmt.Errorf("Invalid %s %q", name, value)
+			return nil
+		}
+		return &t
+	}
+	record := Record{
+		Kind:         RecordKind(field("kind")),
+		ID:           parseInt("id"),
+		Email:        field("email"),
+		PasswordHash: field("password_hash"),
+		Body:         field("body"),
+		AuthorID:     parseInt("author_id"),
+		UserID:       parseInt("user_id"),
+		TokenHash:    field("token_hash"),
+		UpdatedAt:    parseTime("updated_at"),
+		DeletedAt:    parseTime("deleted_at"),
+		ExpiresAt:    parseTime("expires_at"),
+	}
+	if createdAt := parseTime("created_at"); createdAt != nil {
+		record.CreatedAt = *createdAt
+	}
+	if value := field("is_chirpy_red"); value != "" && err == nil {
+		record.IsChirpyRed, err = strconv.ParseBool(value)
+		if err != nil {
+			err = fmt.Errorf("Invalid is_chirpy_red %q", value)
+		}
+	}
+	return record, err
+}
+
+// importRecords adds records to the database under new IDs. Chirps and
+// tokens refer to users by their IDs in the import, which are mapped to the
+// new ones, so their users must come earlier in the import. A user whose
+// email already exists is matched to that user rather than created again,
+// and their records are only imported as opts allow.
+func (tx *Tx) importRecords(records []numberedRecord, opts ImportOptions, report *ImportReport) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+	report.UserIDs = make(map[int]int)
+	report.ChirpIDs = make(map[int]int)
+	imported := make(map[string]bool)
+	// matched holds the import IDs of users matched to existing ones.
+	matched := make(map[int]bool)
+	reject := func(line int, format string, a ...any) {
+		report.Errors = append(report.Errors, ImportError{Line: line, Err: fmt.Sprintf(format, a...)})
+	}
+	now := time.Now().UTC()
+	createdAt := func(record Record) time.Time {
+		if record.CreatedAt.IsZero() {
+			return now
+		}
+		return record.CreatedAt.UTC()
+	}
+	updatedAt := func(record Record) time.Time {
+		if record.UpdatedAt == nil || record.UpdatedAt.IsZero() {
+			return createdAt(record)
+		}
+		return record.UpdatedAt.UTC()
+	}
+
+	for _, nr := range records {
+		line, record := nr.line, nr.record
+		switch record.Kind {
+		case RecordUser:
+			if record.ID <= 0 {
+				reject(line, "User has no id")
+				continue
+			}
+			if _, ok := report.UserIDs[record.ID]; ok {
+				reject(line, "Duplicate user id %d", record.ID)
+				continue
+			}
+			if record.Email == "" {
+				reject(line, "User %d has no email", record.ID)
+				continue
+			}
+			if imported[record.Email] {
+				reject(line, "Duplicate email %s", record.Email)
+				continue
+			}
+			if record.PasswordHash != "" {
+				if _, err := bcrypt.Cost([]byte(record.PasswordHash)); err != nil {
+					reject(line, "User %d has an invalid password hash", record.ID)
+					continue
+				}
+			}
+			imported[record.Email] = true
+			if existing, err := tx.GetUserByEmail(record.Email); err == nil {
+				report.UserIDs[record.ID] = existing.Id
+				matched[record.ID] = true
+				report.MatchedUsers++
+				continue
+			}
+			user := User{Id: tx.ids.nextID(tx.data.NextUserID, now), Email: record.Email, IsChirpyRed: record.IsChirpyRed, CreatedAt: createdAt(record), UpdatedAt: updatedAt(record)}
+			if record.PasswordHash != "" {
+				user.Password = []byte(record.PasswordHash)
+			}
+			tx.putUser(user)
+			report.UserIDs[record.ID] = user.Id
+			report.Users++
+		case RecordChirp:
+			if record.ID <= 0 {
+				reject(line, "Chirp has no id")
+				continue
+			}
+			if _, ok := report.ChirpIDs[record.ID]; ok {
+				reject(line, "Duplicate chirp id %d", record.ID)
+				continue
+			}
+			authorID, ok := report.UserIDs[record.AuthorID]
+			if !ok {
+				reject(line, "Chirp %d is by user %d, who isn't in the import", record.ID, record.AuthorID)
+				continue
+			}
+			if matched[record.AuthorID] && !opts.MergeMatchedUsers {
+				reject(line, "Chirp %d is by user %d, who matched an existing user; merging into existing users is off", record.ID, record.AuthorID)
+				continue
+			}
+			if strings.TrimSpace(record.Body) == "" {
+				reject(line, "Chirp %d has no body", record.ID)
+				continue
+			}
+			if opts.MaxBodyLength > 0 && len(record.Body) > opts.MaxBodyLength {
+				reject(line, "Chirp %d is longer than %d characters", record.ID, opts.MaxBodyLength)
+				continue
+			}
+			chirp := Chirp{Id: tx.ids.nextID(tx.data.NextChirpID, now), Body: record.Body, AuthorID: authorID, CreatedAt: createdAt(record), UpdatedAt: updatedAt(record)}
+			if record.DeletedAt != nil {
+				deletedAt := record.DeletedAt.UTC()
+				chirp.DeletedAt = &deletedAt
+			}
+			tx.putChirp(chirp)
+			report.ChirpIDs[record.ID] = chirp.Id
+			report.Chirps++
+		case RecordToken:
+			userID, ok := report.UserIDs[record.UserID]
+			if !ok {
+				reject(line, "Token is for user %d, who isn't in the import", record.UserID)
+				continue
+			}
+			if matched[record.UserID] {
+				reject(line, "Token is for user %d, who matched an existing user", record.UserID)
+				continue
+			}
+			if hash, err := hex.DecodeString(record.TokenHash); err != nil || len(hash) != sha256.Size {
+				reject(line, "Token hash must be %d hex digits", 2*sha256.Size)
+				continue
+			}
+			if _, ok := tx.data.RefreshTokens[record.TokenHash]; ok {
+				reject(line, "Token already exists")
+				continue
+			}
+			token := RefreshToken{UserID: userID, TokenHash: record.TokenHash, CreatedAt: createdAt(record)}
+			if record.ExpiresAt != nil {
+				token.ExpiresAt = record.ExpiresAt.UTC()
+			} else {
+				token.ExpiresAt = token.CreatedAt.Add(legacyRefreshTokenLifetime)
+			}
+			tx.putToken(token)
+			report.Tokens++
+		default:
+			reject(line, "Unknown record kind %q", record.Kind)
+		}
+	}
+	return nil
+}
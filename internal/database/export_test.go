@@ -0,0 +1,191 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// matchedImport is alice, who already exists, and bob, who doesn't, each
+// with a chirp and a refresh token.
+const matchedImport = `{"kind":"user","id":1,"email":"alice@example.com"}
+{"kind":"user","id":2,"email":"bob@example.com"}
+{"kind":"chirp","id":1,"body":"posted as alice","author_id":1}
+{"kind":"chirp","id":2,"body":"posted as bob","author_id":2}
+{"kind":"token","user_id":1,"token_hash":"1111111111111111111111111111111111111111111111111111111111111111"}
+{"kind":"token","user_id":2,"token_hash":"2222222222222222222222222222222222222222222222222222222222222222"}
+`
+
+func TestImportMatchedUsers(t *testing.T) {
+	tests := []struct {
+		name       string
+		merge      bool
+		wantChirps int
+		// wantLines are the lines rejected.
+		wantLines []int
+	}{
+		{"default", false, 1, []int{3, 5}},
+		{"merge", true, 2, []int{5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemStore(Options{})
+			alice, err := s.CreateUser("alice@example.com", []byte("hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := s.Import(strings.NewReader(matchedImport), ImportOptions{Format: FormatJSONL, MergeMatchedUsers: tt.merge})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Users != 1 || report.MatchedUsers != 1 || report.Chirps != tt.wantChirps || report.Tokens != 1 {
+				t.Errorf("got %+v", report)
+			}
+			lines := []int{}
+			for _, e := range report.Errors {
+				lines = append(lines, e.Line)
+			}
+			if !slices.Equal(lines, tt.wantLines) {
+				t.Errorf("rejected lines %v, want %v", lines, tt.wantLines)
+			}
+
+			err = s.View(func(tx *Tx) error {
+				if _, ok := tx.data.RefreshTokens[strings.Repeat("1", 64)]; ok {
+					t.Error("a token was imported for the existing user")
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			page, err := s.QueryChirps(ChirpQuery{AuthorIDs: []int{alice.Id}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if merged := len(page.Chirps) == 1; merged != tt.merge {
+				t.Errorf("existing user has %d chirps, merge %v", len(page.Chirps), tt.merge)
+			}
+		})
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	for _, format := range []Format{FormatJSONL, FormatCSV} {
+		t.Run(string(format), func(t *testing.T) {
+			src := NewMemStore(Options{})
+			createTestUsers(t, src, 2)
+			users, err := src.GetUsers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, user := range users {
+				_, err := src.CreateChirp("hello from "+user.Email, user.Id)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = src.DeleteChirpByID(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out strings.Builder
+			err = src.Export(&out, ExportOptions{Format: format})
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Count(out.String(), "\n")
+			if format == FormatCSV {
+				lines--
+			}
+			if lines != 4 {
+				t.Errorf("exported %d records, want 4:\n%s", lines, out.String())
+			}
+
+			dst := NewMemStore(Options{})
+			report, err := dst.Import(strings.NewReader(out.String()), ImportOptions{Format: format})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Users != 2 || report.Chirps != 2 || report.Skipped != 0 {
+				t.Errorf("got %+v", report)
+			}
+			_, err = dst.GetChirpByID(report.ChirpIDs[1])
+			if !errors.Is(err, ErrGone) {
+				t.Errorf("deleted chirp: got %v, want ErrGone", err)
+			}
+		})
+	}
+}
+
+func TestExportRejectsBadOptions(t *testing.T) {
+	s := NewMemStore(Options{})
+	var out strings.Builder
+	err := s.Export(&out, ExportOptions{Format: FormatCSV, Kinds: []RecordKind{"secrets"}})
+	if !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, want ErrInvalidQuery", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("wrote %q before rejecting the options", out.String())
+	}
+}
+
+// stalledWriter is a client that stops reading: its first Write signals
+// started and then blocks until release is closed.
+type stalledWriter struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	select {
+	case <-w.started:
+	default:
+		close(w.started)
+	}
+	<-w.release
+	return len(p), nil
+}
+
+func TestExportDoesNotBlockWriters(t *testing.T) {
+	db, path := openTestDB(t)
+	other := reopenTestDB(t, path)
+	createTestUsers(t, db, 1)
+
+	w := &stalledWriter{started: make(chan struct{}), release: make(chan struct{})}
+	release := sync.OnceFunc(func() { close(w.release) })
+	// Registered after the DBs' cleanups, so it runs before they close.
+	t.Cleanup(release)
+	exported := make(chan error, 1)
+	go func() {
+		exported <- db.Export(w, ExportOptions{Format: FormatJSONL})
+	}()
+	<-w.started
+
+	// Both the exporting handle and another one, which stands in for
+	// another process, can still write while the export is stuck.
+	for _, s := range []*DB{db, other} {
+		created := make(chan error, 1)
+		go func() {
+			_, err := s.CreateChirp("still writable", 1)
+			created <- err
+		}()
+		select {
+		case err := <-created:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("CreateChirp waited for a stalled export")
+		}
+	}
+
+	release()
+	err := <-exported
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,37 @@
+package database
+
+import "time"
+
+// IDScheme picks how new chirp and user IDs are allocated. Either way IDs
+// only ever go up and are never handed out twice, even after the record
+// holding the newest one is deleted.
+type IDScheme int
+
+const (
+	// IDSequence allocates 1, 2, 3, ...
+	IDSequence IDScheme = iota
+	// IDTimeOrdered allocates snowflake-style IDs: milliseconds since
+	// idEpoch shifted left by idSeqBits, so IDs sort by creation time. They
+	// fit in 53 bits and stay exact as JavaScript numbers.
+	IDTimeOrdered
+)
+
+var idEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// idSeqBits leaves room for 1024 IDs per millisecond before the allocator
+// runs ahead of the clock.
+const idSeqBits = 10
+
+// nextID returns the ID to use given next, the lowest ID not yet handed out.
+func (scheme IDScheme) nextID(next int, now time.Time) int {
+	if next < 1 {
+		next = 1
+	}
+	if scheme == IDTimeOrdered {
+		timeID := int(now.Sub(idEpoch).Milliseconds()) << idSeqBits
+		if timeID > next {
+			return timeID
+		}
+	}
+	return next
+}
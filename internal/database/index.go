@@ -0,0 +1,106 @@
+package database
+
+import "slices"
+
+// indexes are in-memory lookups derived from a DBStructure. They are never
+// written to disk: they are built when a snapshot is loaded and kept up to
+// date by DBStructure.apply, which every change goes through, including
+// journal replay and rollback.
+type indexes struct {
+	userByEmail map[string]int
+	// chirpIDs and chirpsByAuthor hold chirp IDs in ascending order.
+	chirpIDs       []int
+	chirpsByAuthor map[int][]int
+	// chirpsByTime holds chirp IDs ordered by CreatedAt, then ID.
+	chirpsByTime keyList
+	// text indexes chirp bodies for SearchChirps.
+	text textIndex
+}
+
+func (dbStructure *DBStructure) buildIndexes() {
+	idx := indexes{
+		userByEmail:    make(map[string]int, len(dbStructure.Users)),
+		chirpIDs:       make([]int, 0, len(dbStructure.Chirps)),
+		chirpsByTime:   make(keyList, 0, len(dbStructure.Chirps)),
+		chirpsByAuthor: make(map[int][]int),
+		text:           newTextIndex(),
+	}
+	for _, user := range dbStructure.Users {
+		idx.addUser(user)
+	}
+	for id, chirp := range dbStructure.Chirps {
+		if chirp.DeletedAt != nil {
+			continue
+		}
+		idx.chirpIDs = append(idx.chirpIDs, id)
+		idx.chirpsByTime = append(idx.chirpsByTime, timeKey(chirp))
+		idx.chirpsByAuthor[chirp.AuthorID] = append(idx.chirpsByAuthor[chirp.AuthorID], id)
+		idx.text.terms = append(idx.text.terms, idx.text.addPostings(chirp)...)
+	}
+	slices.Sort(idx.chirpIDs)
+	slices.SortFunc(idx.chirpsByTime, compareKeys)
+	slices.Sort(idx.text.terms)
+	for _, ids := range idx.chirpsByAuthor {
+		slices.Sort(ids)
+	}
+	dbStructure.idx = &idx
+}
+
+func (idx *indexes) addUser(user User) {
+	idx.userByEmail[user.Email] = user.Id
+}
+
+func (idx *indexes) removeUser(user User) {
+	if idx.userByEmail[user.Email] == user.Id {
+		delete(idx.userByEmail, user.Email)
+	}
+}
+
+// addChirp and removeChirp skip soft-deleted chirps, which are never in
+// the indexes.
+func (idx *indexes) addChirp(chirp Chirp) {
+	if chirp.DeletedAt != nil {
+		return
+	}
+	idx.chirpIDs = insertSorted(idx.chirpIDs, chirp.Id)
+	if i, found := slices.BinarySearchFunc(idx.chirpsByTime, timeKey(chirp), compareKeys); !found {
+		idx.chirpsByTime = slices.Insert(idx.chirpsByTime, i, timeKey(chirp))
+	}
+	idx.chirpsByAuthor[chirp.AuthorID] = insertSorted(idx.chirpsByAuthor[chirp.AuthorID], chirp.Id)
+	idx.text.add(chirp)
+}
+
+func (idx *indexes) removeChirp(chirp Chirp) {
+	if chirp.DeletedAt != nil {
+		return
+	}
+	idx.chirpIDs = removeSorted(idx.chirpIDs, chirp.Id)
+	if i, found := slices.BinarySearchFunc(idx.chirpsByTime, timeKey(chirp), compareKeys); found {
+		idx.chirpsByTime = slices.Delete(idx.chirpsByTime, i, i+1)
+	}
+	ids := removeSorted(idx.chirpsByAuthor[chirp.AuthorID], chirp.Id)
+	if len(ids) == 0 {
+		delete(idx.chirpsByAuthor, chirp.AuthorID)
+	} else {
+		idx.chirpsByAuthor[chirp.AuthorID] = ids
+	}
+	idx.text.remove(chirp)
+}
+
+// insertSorted adds id to the ascending slice ids. New chirps always get the
+// highest ID so far, which makes this an append in the common case.
+func insertSorted(ids []int, id int) []int {
+	i, found := slices.BinarySearch(ids, id)
+	if found {
+		return ids
+	}
+	return slices.Insert(ids, i, id)
+}
+
+func removeSorted(ids []int, id int) []int {
+	i, found := slices.BinarySearch(ids, id)
+	if !found {
+		return ids
+	}
+	return slices.Delete(ids, i, i+1)
+}
@@ -0,0 +1,257 @@
+package database
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+)
+
+// journal is the append-only log of committed transactions. Each line is one
+// journalRecord prefixed with a CRC-32 of its JSON, so a commit costs a
+// single append no matter how large the database is:
+//
+//	1c291ca3 {"seq":7,"ops":[...]}
+//
+// When the database is encrypted the JSON is sealed with the active key and
+// written as "enc:<key ID>:<base64>" instead.
+type journal struct {
+	file *os.File
+	keys *Keyring
+	// seq is the sequence number of the last record written or replayed.
+	seq int64
+	// records counts the records currently in the file.
+	records int
+	// offset is how far into the file this process has read or written, and
+	// info identifies the file, so appends and compactions made by other
+	// processes can be detected.
+	offset int64
+	info   os.FileInfo
+	// readOnly journals leave a damaged final record in place.
+	readOnly bool
+}
+
+type journalRecord struct {
+	Seq int64 `json:"seq"`
+	Ops []op  `json:"ops"`
+}
+
+// errJournalGap means the journal doesn't continue from the snapshot it is
+// being replayed onto.
+var errJournalGap = errors.New("Journal does not continue from the snapshot")
+
+// errJournalReplaced means the journal was truncated or replaced by another
+// process, so it has to be read again from the start.
+var errJournalReplaced = errors.New("Journal was replaced")
+
+func openJournal(path string, keys *Keyring) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, ioError("Opening journal", err)
+	}
+	return &journal{file: file, keys: keys}, nil
+}
+
+// openJournalReadOnly opens a journal for inspection. It returns nil if
+// there is no journal.
+func openJournalReadOnly(path string, keys *Keyring) (*journal, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, ioError("Opening journal", err)
+	}
+	return &journal{file: file, keys: keys, readOnly: true}, nil
+}
+
+const encryptedPrefix = "enc:"
+
+func encodeJournalLine(record journalRecord, keys *Keyring) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil {
+		keyID, sealed, err := keys.seal(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = fmt.Appendf(nil, "%s%s:%s", encryptedPrefix, keyID, base64.StdEncoding.EncodeToString(sealed))
+	}
+	line := fmt.Appendf(nil, "%08x ", crc32.ChecksumIEEE(payload))
+	line = append(line, payload...)
+	return append(line, '\n'), nil
+}
+
+func decodeJournalLine(line []byte, keys *Keyring) (journalRecord, error) {
+	record := journalRecord{}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	if bytes.HasPrefix(line, []byte("{")) {
+		// Records written before checksums were added.
+		err := json.Unmarshal(line, &record)
+		return record, err
+	}
+	sum, payload, found := bytes.Cut(line, []byte(" "))
+	if !found {
+		return record, errors.New("Missing checksum")
+	}
+	if string(sum) != fmt.Sprintf("%08x", crc32.ChecksumIEEE(payload)) {
+		return record, errors.New("Checksum mismatch")
+	}
+	if sealed, found := bytes.CutPrefix(payload, []byte(encryptedPrefix)); found {
+		keyID, encoded, found := bytes.Cut(sealed, []byte(":"))
+		if !found {
+			return record, errors.New("Missing key ID")
+		}
+		sealed, err := base64.StdEncoding.DecodeString(string(encoded))
+		if err != nil {
+			return record, err
+		}
+		payload, err = keys.open(string(keyID), sealed)
+		if err != nil {
+			return record, err
+		}
+	}
+	err := json.Unmarshal(payload, &record)
+	return record, err
+}
+
+// replay applies every record newer than dbStructure.JournalSeq, reading
+// the journal from the start.
+func (j *journal) replay(dbStructure *DBStructure) error {
+	j.seq = dbStructure.JournalSeq
+	j.offset = 0
+	j.records = 0
+	info, err := j.file.Stat()
+	if err != nil {
+		return ioError("Reading journal", err)
+	}
+	j.info = info
+	return j.catchUp(dbStructure)
+}
+
+// changed reports whether the journal at path has grown, shrunk or been
+// replaced since this process last read it.
+func (j *journal) changed(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, ioError("Reading journal", err)
+	}
+	return !os.SameFile(info, j.info) || info.Size() != j.offset, nil
+}
+
+// catchUp applies the records written after j.offset. Every new record is
+// checked before anything is applied, so an error leaves dbStructure as it
+// was.
+//
+// A damaged final record is a write that was cut short by a crash. It was
+// never acknowledged to its caller, so it is dropped; damage anywhere else
+// is reported as an error.
+func (j *journal) catchUp(dbStructure *DBStructure) error {
+	info, err := os.Stat(j.file.Name())
+	if err != nil {
+		return ioError("Reading journal", err)
+	}
+	if !os.SameFile(info, j.info) || info.Size() < j.offset {
+		return errJournalReplaced
+	}
+	raw, err := io.ReadAll(io.NewSectionReader(j.file, j.offset, info.Size()-j.offset))
+	if err != nil {
+		return ioError("Reading journal", err)
+	}
+	records := []journalRecord{}
+	offset := j.offset
+	for len(raw) > 0 {
+		line := raw
+		if i := bytes.IndexByte(raw, '\n'); i >= 0 {
+			line = raw[:i+1]
+		}
+		record, err := decodeJournalLine(line, j.keys)
+		if errors.Is(err, ErrKey) {
+			// The record is intact but can't be read with these keys. It
+			// must not be mistaken for a torn write and dropped.
+			return err
+		}
+		if err != nil {
+			if len(line) == len(raw) {
+				if j.readOnly {
+					break
+				}
+				log.Printf("Dropping incomplete journal record at offset %d: %v", offset, err)
+				err = j.file.Truncate(offset)
+				if err != nil {
+					return ioError("Truncating journal", err)
+				}
+				break
+			}
+			return corruptError("Bad journal record at offset %d: %v", offset, err)
+		}
+		records = append(records, record)
+		offset += int64(len(line))
+		raw = raw[len(line):]
+	}
+
+	seq := j.seq
+	for _, record := range records {
+		if record.Seq <= seq {
+			continue
+		}
+		if record.Seq != seq+1 {
+			return fmt.Errorf("%w: expected record %d, found %d: %w", errJournalGap, seq+1, record.Seq, ErrCorrupt)
+		}
+		seq = record.Seq
+	}
+
+	for _, record := range records {
+		if record.Seq <= j.seq {
+			continue
+		}
+		for _, o := range record.Ops {
+			dbStructure.applyLogged(o)
+		}
+		j.seq = record.Seq
+	}
+	j.records += len(records)
+	j.offset = offset
+	return nil
+}
+
+// append writes ops as the next record and waits for it to reach the disk.
+func (j *journal) append(ops []op) error {
+	line, err := encodeJournalLine(journalRecord{Seq: j.seq + 1, Ops: ops}, j.keys)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(line)
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		return ioError("Appending to journal", err)
+	}
+	j.seq++
+	j.records++
+	j.offset += int64(len(line))
+	return nil
+}
+
+// truncate empties the journal once its records are safely in a snapshot.
+func (j *journal) truncate() error {
+	err := j.file.Truncate(0)
+	if err != nil {
+		return ioError("Truncating journal", err)
+	}
+	j.records = 0
+	j.offset = 0
+	return nil
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestDB opens a DB in a fresh directory and closes it when the test
+// ends.
+func openTestDB(t *testing.T) (*DB, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := reopenTestDB(t, path)
+	return db, path
+}
+
+// reopenTestDB opens another handle on the DB at path.
+func reopenTestDB(t *testing.T, path string) *DB {
+	t.Helper()
+	db, err := NewDB(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// crash drops db's files without compacting, as if the process had died.
+func crash(db *DB) {
+	db.journal.close()
+	db.lock.close()
+}
+
+func createTestUsers(t *testing.T, db Store, n int) {
+	t.Helper()
+	users, err := db.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := len(users); i < len(users)+n; i++ {
+		_, err := db.CreateUser(fmt.Sprintf("user%d@example.com", i), []byte("hash"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func countUsers(t *testing.T, db Store) int {
+	t.Helper()
+	users, err := db.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(users)
+}
+
+func TestJournalDropsTornFinalRecord(t *testing.T) {
+	db, path := openTestDB(t)
+	createTestUsers(t, db, 2)
+	crash(db)
+
+	journalPath := path + ".journal"
+	intact, err := os.Stat(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteString(`0badc0de {"seq":3,"ops":[{"ki`)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := reopenTestDB(t, path)
+	if got := countUsers(t, reopened); got != 2 {
+		t.Errorf("got %d users after replay, want 2", got)
+	}
+	info, err := os.Stat(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != intact.Size() {
+		t.Errorf("journal is %d bytes, want the torn record truncated to %d", info.Size(), intact.Size())
+	}
+	// The next record takes the place of the dropped one.
+	createTestUsers(t, reopened, 1)
+	crash(reopened)
+	if got := countUsers(t, reopenTestDB(t, path)); got != 3 {
+		t.Errorf("got %d users after appending past the torn record, want 3", got)
+	}
+}
+
+func TestJournalRejectsDamageBeforeFinalRecord(t *testing.T) {
+	db, path := openTestDB(t)
+	createTestUsers(t, db, 2)
+	crash(db)
+
+	journalPath := path + ".journal"
+	raw, err := os.ReadFile(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte inside the first record's payload.
+	raw[20] ^= 0x01
+	err = os.WriteFile(journalPath, raw, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDB(path, Options{})
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("got %v, want ErrCorrupt", err)
+	}
+}
+
+func TestSecondHandleSeesAppends(t *testing.T) {
+	first, path := openTestDB(t)
+	second := reopenTestDB(t, path)
+
+	createTestUsers(t, first, 2)
+	if got := countUsers(t, second); got != 2 {
+		t.Errorf("second handle sees %d users, want 2", got)
+	}
+	createTestUsers(t, second, 1)
+	if got := countUsers(t, first); got != 3 {
+		t.Errorf("first handle sees %d users, want 3", got)
+	}
+	// Both handles append from the same sequence number on.
+	createTestUsers(t, first, 1)
+	createTestUsers(t, second, 1)
+	if got := countUsers(t, first); got != 5 {
+		t.Errorf("first handle sees %d users, want 5", got)
+	}
+}
+
+func TestSecondHandleSeesCompaction(t *testing.T) {
+	first, path := openTestDB(t)
+	second := reopenTestDB(t, path)
+
+	createTestUsers(t, first, 2)
+	if got := countUsers(t, second); got != 2 {
+		t.Fatalf("second handle sees %d users, want 2", got)
+	}
+	// Rewrite compacts, replacing the snapshot and emptying the journal.
+	err := first.Rewrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestUsers(t, first, 1)
+	if got := countUsers(t, second); got != 3 {
+		t.Errorf("second handle sees %d users after compaction, want 3", got)
+	}
+	createTestUsers(t, second, 1)
+	if got := countUsers(t, first); got != 4 {
+		t.Errorf("first handle sees %d users, want 4", got)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package database
+
+// fileLock is a no-op where flock(2) isn't available. A database on these
+// platforms must only be opened by one process at a time.
+type fileLock struct{}
+
+func openFileLock(path string) (*fileLock, error) {
+	return &fileLock{}, nil
+}
+
+func (l *fileLock) lock() error   { return nil }
+func (l *fileLock) rlock() error  { return nil }
+func (l *fileLock) unlock() error { return nil }
+func (l *fileLock) close() error  { return nil }
@@ -0,0 +1,51 @@
+//go:build unix
+
+package database
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fileLock is an advisory flock(2) lock shared by every process that opens
+// the same database. The in-process mutex must be held while using it, since
+// the lock belongs to the open file rather than to a goroutine.
+type fileLock struct {
+	file *os.File
+}
+
+func openFileLock(path string) (*fileLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileLock{file: file}, nil
+}
+
+// lock takes the lock exclusively, for writers.
+func (l *fileLock) lock() error {
+	return l.flock(syscall.LOCK_EX)
+}
+
+// rlock takes the lock shared, for readers.
+func (l *fileLock) rlock() error {
+	return l.flock(syscall.LOCK_SH)
+}
+
+func (l *fileLock) unlock() error {
+	return l.flock(syscall.LOCK_UN)
+}
+
+func (l *fileLock) flock(how int) error {
+	for {
+		err := syscall.Flock(int(l.file.Fd()), how)
+		if !errors.Is(err, syscall.EINTR) {
+			return err
+		}
+	}
+}
+
+func (l *fileLock) close() error {
+	return l.file.Close()
+}
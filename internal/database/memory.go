@@ -0,0 +1,69 @@
+package database
+
+import "sync"
+
+// MemStore is a Store that keeps all data in memory. Nothing is persisted, so
+// it suits tests and throwaway instances.
+type MemStore struct {
+	txStore
+	*EventBus
+	opts Options
+	data DBStructure
+	mux  *sync.RWMutex
+}
+
+func NewMemStore(opts Options) *MemStore {
+	s := MemStore{opts: opts, data: newDBStructure(), mux: &sync.RWMutex{}, EventBus: newEventBus(0)}
+	s.txStore = txStore{view: s.View, update: s.Update}
+	return &s
+}
+
+func (s *MemStore) View(fn func(tx *Tx) error) error {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return fn(&Tx{data: &s.data})
+}
+
+// Update runs fn and undoes its changes if it returns an error, matching DB
+// where a failed Update never reaches the file.
+func (s *MemStore) Update(fn func(tx *Tx) error) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	tx := Tx{data: &s.data, writable: true, ids: s.opts.IDs}
+	err := fn(&tx)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	s.EventBus.publish(s.data.pending)
+	s.data.pending = nil
+	return nil
+}
+
+func (s *MemStore) Close() error {
+	return nil
+}
+
+func (s *MemStore) Backup(dir string, retain int) (Archive, error) {
+	s.mux.RLock()
+	raw, err := encodeSnapshot(s.data, s.opts)
+	s.mux.RUnlock()
+	if err != nil {
+		return Archive{}, err
+	}
+	return writeArchive(raw, dir, retain, s.opts.Keys)
+}
+
+func (s *MemStore) Restore(path string) error {
+	_, restored, err := readArchive(path, s.opts.Keys)
+	if err != nil {
+		return err
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	restored.NextChirpID = max(restored.NextChirpID, s.data.NextChirpID)
+	restored.NextUserID = max(restored.NextUserID, s.data.NextUserID)
+	restored.EventSeq = max(restored.EventSeq, s.data.EventSeq)
+	s.data = restored
+	return nil
+}
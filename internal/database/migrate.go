@@ -0,0 +1,206 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Migration upgrades a DBStructure from the previous schema version to
+// Version. Migrate reports how many records it changed.
+type Migration struct {
+	Version     int
+	Description string
+	Migrate     func(dbStructure *DBStructure) (changed int, err error)
+}
+
+// MigrationReport describes a migration that ran, or would run in a dry run.
+type MigrationReport struct {
+	Version     int
+	Description string
+	Changed     int
+}
+
+func (r MigrationReport) String() string {
+	return fmt.Sprintf("v%d: %s (%d records changed)", r.Version, r.Description, r.Changed)
+}
+
+// migrations must stay in version order. Never edit one that has shipped;
+// add a new one instead.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Store refresh tokens under refresh_token instead of Token",
+		Migrate:     migrateRefreshTokenField,
+	},
+	{
+		Version:     2,
+		Description: "Add ID counters so deleted IDs are never reused",
+		Migrate:     migrateIDCounters,
+	},
+	{
+		Version:     3,
+		Description: "Add created_at and updated_at to chirps and users",
+		Migrate:     migrateTimestamps,
+	},
+	{
+		Version:     4,
+		Description: "Store refresh tokens as SHA-256 hashes with an expiry time",
+		Migrate:     migrateHashRefreshTokens,
+	},
+}
+
+// SchemaVersion is the version of the data written by this build.
+var SchemaVersion = migrations[len(migrations)-1].Version
+
+// migrate runs every migration newer than dbStructure.Version, in order.
+// Files without a version predate versioning and count as version 0.
+func migrate(dbStructure *DBStructure) ([]MigrationReport, error) {
+	if dbStructure.Version > SchemaVersion {
+		return nil, fmt.Errorf("Database is at schema version %d but this build only knows up to %d: %w", dbStructure.Version, SchemaVersion, ErrCorrupt)
+	}
+	reports := []MigrationReport{}
+	for _, m := range migrations {
+		if m.Version <= dbStructure.Version {
+			continue
+		}
+		changed, err := m.Migrate(dbStructure)
+		if err != nil {
+			return reports, fmt.Errorf("Migration to schema version %d failed: %w", m.Version, err)
+		}
+		dbStructure.Version = m.Version
+		reports = append(reports, MigrationReport{Version: m.Version, Description: m.Description, Changed: changed})
+	}
+	if len(reports) > 0 {
+		dbStructure.buildIndexes()
+	}
+	return reports, nil
+}
+
+// PlanMigrations is a dry run of the migrations NewDB would run on the
+// database at path. Nothing on disk is changed.
+func PlanMigrations(path string, opts Options) ([]MigrationReport, error) {
+	lock, err := openFileLock(path + ".lock")
+	if err != nil {
+		return nil, ioError("Opening lock file", err)
+	}
+	defer lock.close()
+	err = lock.rlock()
+	if err != nil {
+		return nil, ioError("Locking database", err)
+	}
+	defer lock.unlock()
+
+	data, _, err := readSnapshot(path, opts.Keys)
+	if err != nil {
+		return nil, err
+	}
+	j, err := openJournalReadOnly(path+".journal", opts.Keys)
+	if err != nil {
+		return nil, err
+	}
+	if j != nil {
+		defer j.close()
+		err = j.replay(&data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return migrate(&data)
+}
+
+func logMigrations(path string, reports []MigrationReport) {
+	for _, report := range reports {
+		log.Printf("Migrated %s to schema %s", path, report)
+	}
+}
+
+// migrateRefreshTokenField fills in RefreshToken.Token. Its struct tag used
+// to be malformed, so the value was written under the key "Token", which
+// the fixed tag no longer reads. The token is also the map key, so nothing
+// is lost.
+func migrateRefreshTokenField(dbStructure *DBStructure) (int, error) {
+	changed := 0
+	for key, token := range dbStructure.RefreshTokens {
+		if token.Token != key {
+			token.Token = key
+			dbStructure.RefreshTokens[key] = token
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// migrateIDCounters starts the ID counters after the highest IDs in use and
+// reports how many of the two counters it set. IDs freed by deletions
+// before this migration can't be recovered.
+func migrateIDCounters(dbStructure *DBStructure) (int, error) {
+	nextChirpID, nextUserID := 1, 1
+	for id := range dbStructure.Chirps {
+		nextChirpID = max(nextChirpID, id+1)
+	}
+	for id := range dbStructure.Users {
+		nextUserID = max(nextUserID, id+1)
+	}
+	changed := 0
+	if dbStructure.NextChirpID < nextChirpID {
+		dbStructure.NextChirpID = nextChirpID
+		changed++
+	}
+	if dbStructure.NextUserID < nextUserID {
+		dbStructure.NextUserID = nextUserID
+		changed++
+	}
+	return changed, nil
+}
+
+// legacyRefreshTokenLifetime is how long refresh tokens lasted when their
+// expiry was worked out from CreatedAt rather than stored.
+const legacyRefreshTokenLifetime = 60 * 24 * time.Hour
+
+// migrateHashRefreshTokens re-keys refresh tokens by their hash and drops
+// the tokens themselves, so the database files no longer hold anything a
+// client could sign in with. Clients keep their tokens, which still work.
+// Existing tokens expire when the old rule said they would.
+func migrateHashRefreshTokens(dbStructure *DBStructure) (int, error) {
+	hashed := make(map[string]RefreshToken, len(dbStructure.RefreshTokens))
+	changed := 0
+	for key, token := range dbStructure.RefreshTokens {
+		if token.TokenHash == "" {
+			// The key is the token itself, see migrateRefreshTokenField.
+			token.TokenHash = HashRefreshToken(key)
+			token.Token = ""
+			changed++
+		}
+		if token.ExpiresAt.IsZero() {
+			token.ExpiresAt = token.CreatedAt.Add(legacyRefreshTokenLifetime)
+		}
+		hashed[token.TokenHash] = token
+	}
+	dbStructure.RefreshTokens = hashed
+	return changed, nil
+}
+
+// migrateTimestamps gives records written before timestamps existed the
+// time of the migration. Their real creation time was never stored; sorting
+// by time falls back to ID order among them, which matches the order they
+// were created in.
+func migrateTimestamps(dbStructure *DBStructure) (int, error) {
+	now := time.Now().UTC()
+	changed := 0
+	for id, chirp := range dbStructure.Chirps {
+		if chirp.CreatedAt.IsZero() {
+			chirp.CreatedAt, chirp.UpdatedAt = now, now
+			dbStructure.Chirps[id] = chirp
+			changed++
+		}
+	}
+	for id, user := range dbStructure.Users {
+		if user.CreatedAt.IsZero() {
+			user.CreatedAt, user.UpdatedAt = now, now
+			dbStructure.Users[id] = user
+			changed++
+		}
+	}
+	return changed, nil
+}
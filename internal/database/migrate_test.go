@@ -0,0 +1,125 @@
+package database
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// baselineSnapshot is a database as the first release wrote it: no version
+// or ID counters, no timestamps on chirps and users, and refresh tokens
+// keyed by the token itself with the value under the malformed "Token" tag.
+const baselineSnapshot = `{"chirps":{"1":{"id":1,"body":"First chirp","author_id":1}},` +
+	`"users":{"1":{"id":1,"email":"first@example.com","Password":"aGFzaA==","is_chirpy_red":false},` +
+	`"2":{"id":2,"email":"second@example.com","Password":"aGFzaA==","is_chirpy_red":true}},` +
+	`"refresh_tokens":{"token-one":{"user_id":1,"Token":"token-one","created_at":"2024-07-01T12:00:00Z"},` +
+	`"token-two":{"user_id":2,"Token":"token-two","created_at":"2024-07-15T08:30:00Z"}}}`
+
+// writeBaselineDB writes baselineSnapshot to a fresh directory and returns
+// its path.
+func writeBaselineDB(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "database.json")
+	err := os.WriteFile(path, []byte(baselineSnapshot), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPlanMigrationsOnBaselineFile(t *testing.T) {
+	path := writeBaselineDB(t)
+
+	reports, err := PlanMigrations(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{2, 2, 3, 2}
+	if len(reports) != len(want) {
+		t.Fatalf("got %d migrations, want %d: %v", len(reports), len(want), reports)
+	}
+	for i, report := range reports {
+		if report.Version != migrations[i].Version || report.Changed != want[i] {
+			t.Errorf("got %v, want v%d with %d records changed", report, migrations[i].Version, want[i])
+		}
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, []byte(baselineSnapshot)) {
+		t.Errorf("dry run changed the snapshot")
+	}
+}
+
+func TestMigrateRefreshTokenField(t *testing.T) {
+	dbStructure, err := decodeSnapshot([]byte(baselineSnapshot), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := dbStructure.RefreshTokens["token-one"].Token; token != "" {
+		t.Fatalf("baseline token decoded as %q, want it lost to the old tag", token)
+	}
+	changed, err := migrateRefreshTokenField(&dbStructure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != 2 {
+		t.Errorf("changed %d tokens, want 2", changed)
+	}
+	for key, token := range dbStructure.RefreshTokens {
+		if token.Token != key {
+			t.Errorf("token %s has Token %q", key, token.Token)
+		}
+	}
+}
+
+func TestMigrateBaselineRefreshTokens(t *testing.T) {
+	path := writeBaselineDB(t)
+	db := reopenTestDB(t, path)
+
+	for token, createdAt := range map[string]string{
+		"token-one": "2024-07-01T12:00:00Z",
+		"token-two": "2024-07-15T08:30:00Z",
+	} {
+		rToken, err := db.GetRefreshToken(token)
+		if err != nil {
+			t.Errorf("token %s: %v", token, err)
+			continue
+		}
+		if rToken.Token != "" || rToken.TokenHash != HashRefreshToken(token) {
+			t.Errorf("token %s stored as %q with hash %q", token, rToken.Token, rToken.TokenHash)
+		}
+		if got := rToken.CreatedAt.Format(time.RFC3339); got != createdAt {
+			t.Errorf("token %s created at %s, want %s", token, got, createdAt)
+		}
+		if want := rToken.CreatedAt.Add(60 * 24 * time.Hour); !rToken.ExpiresAt.Equal(want) {
+			t.Errorf("token %s expires at %v, want %v", token, rToken.ExpiresAt, want)
+		}
+	}
+
+	// Opening rewrites the snapshot, so the raw tokens are gone from disk.
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("token-one")) {
+		t.Errorf("snapshot still holds a raw refresh token")
+	}
+	snapshot, _, err := readSnapshot(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Version != SchemaVersion {
+		t.Errorf("snapshot is at schema version %d, want %d", snapshot.Version, SchemaVersion)
+	}
+	reports, err := PlanMigrations(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 0 {
+		t.Errorf("migrated snapshot still plans %v", reports)
+	}
+}
@@ -0,0 +1,193 @@
+package database
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Snapshot files start with a header line holding a checksum of the payload
+// that follows it, so a truncated or damaged file is caught on load instead
+// of being read as an empty database:
+//
+//	CHIRPYDB {"format":1,"checksum":"sha256:...","codec":"json"}
+//	{"chirps":{...},...}
+//
+// The codec names how the payload is encoded, see Codec. Files written
+// before the header existed are plain JSON and still load.
+//
+// When the database is encrypted the header also names the cipher and key
+// ID, and the payload is the sealed JSON. The checksum covers the stored
+// bytes, so damage is still told apart from a wrong key.
+const snapshotMagic = "CHIRPYDB "
+
+const snapshotFormat = 1
+
+type snapshotHeader struct {
+	Format   int    `json:"format"`
+	Checksum string `json:"checksum"`
+	Codec    string `json:"codec,omitempty"`
+	Cipher   string `json:"cipher,omitempty"`
+	KeyID    string `json:"key_id,omitempty"`
+}
+
+func checksum(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// encodeSnapshot serializes dbStructure with opts.Codec, encrypting it when
+// opts.Keys is set.
+func encodeSnapshot(dbStructure DBStructure, opts Options) ([]byte, error) {
+	codec := opts.codec()
+	payload, err := codec.Marshal(dbStructure)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := snapshotHeader{Format: snapshotFormat, Codec: codec.Name()}
+	if opts.Keys != nil {
+		snapshot.Cipher = cipherName
+		snapshot.KeyID, payload, err = opts.Keys.seal(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	snapshot.Checksum = checksum(payload)
+	header, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, 0, len(snapshotMagic)+len(header)+1+len(payload))
+	raw = append(raw, snapshotMagic...)
+	raw = append(raw, header...)
+	raw = append(raw, '\n')
+	return append(raw, payload...), nil
+}
+
+// splitSnapshot checks the header of a snapshot and returns it along with the
+// payload. Files without a header get a nil header.
+func splitSnapshot(raw []byte) (*snapshotHeader, []byte, error) {
+	if !bytes.HasPrefix(raw, []byte(snapshotMagic)) {
+		return nil, raw, nil
+	}
+	headerLine, payload, found := bytes.Cut(raw[len(snapshotMagic):], []byte("\n"))
+	if !found {
+		return nil, nil, corruptError("Snapshot header is not terminated")
+	}
+	header := snapshotHeader{}
+	err := json.Unmarshal(headerLine, &header)
+	if err != nil {
+		return nil, nil, corruptError("Couldn't parse snapshot header: %v", err)
+	}
+	if header.Format != snapshotFormat {
+		return nil, nil, corruptError("Unsupported snapshot format %d", header.Format)
+	}
+	if header.Checksum != checksum(payload) {
+		return nil, nil, corruptError("Snapshot checksum mismatch")
+	}
+	if header.Cipher != "" && header.Cipher != cipherName {
+		return nil, nil, corruptError("Unsupported snapshot cipher %q", header.Cipher)
+	}
+	_, err = CodecByName(header.Codec)
+	if err != nil {
+		return nil, nil, corruptError("Unsupported snapshot codec %q", header.Codec)
+	}
+	return &header, payload, nil
+}
+
+// decodeSnapshot parses a snapshot, decrypting it with keys if it is
+// encrypted. Plaintext snapshots load whether or not keys are configured, so
+// an existing database can be switched to encryption.
+func decodeSnapshot(raw []byte, keys *Keyring) (DBStructure, error) {
+	header, payload, err := splitSnapshot(raw)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	codec := JSONCodec
+	if header != nil {
+		if header.Cipher != "" {
+			payload, err = keys.open(header.KeyID, payload)
+			if err != nil {
+				return DBStructure{}, err
+			}
+		}
+		codec, _ = CodecByName(header.Codec)
+	}
+	dbStructure := DBStructure{}
+	err = codec.Unmarshal(payload, &dbStructure)
+	if err != nil {
+		return DBStructure{}, corruptError("Couldn't parse snapshot: %v", err)
+	}
+	if dbStructure.Chirps == nil {
+		dbStructure.Chirps = make(map[int]Chirp)
+	}
+	if dbStructure.Users == nil {
+		dbStructure.Users = make(map[int]User)
+	}
+	if dbStructure.RefreshTokens == nil {
+		dbStructure.RefreshTokens = make(map[string]RefreshToken)
+	}
+	dbStructure.buildIndexes()
+	return dbStructure, nil
+}
+
+func readSnapshot(path string, keys *Keyring) (DBStructure, os.FileInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return DBStructure{}, nil, ioError("Reading snapshot", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return DBStructure{}, nil, ioError("Reading snapshot", err)
+	}
+	raw, err := io.ReadAll(file)
+	if err != nil {
+		return DBStructure{}, nil, ioError("Reading snapshot", err)
+	}
+	dbStructure, err := decodeSnapshot(raw, keys)
+	return dbStructure, info, err
+}
+
+// writeFileAtomic replaces path with data so that a crash at any point leaves
+// either the old file or the new one, never a partial write: the data goes to
+// a temporary file in the same directory, is fsynced, and is then renamed
+// over path.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,316 @@
+package database
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// SortOrder is the direction chirps are returned in.
+type SortOrder int
+
+const (
+	SortAsc SortOrder = iota
+	SortDesc
+)
+
+// SortKey is what chirps are sorted by.
+type SortKey int
+
+const (
+	// SortByID sorts by chirp ID.
+	SortByID SortKey = iota
+	// SortByTime sorts by CreatedAt, then ID for chirps created at the
+	// same instant.
+	SortByTime
+)
+
+// ChirpQuery selects chirps. The zero value matches every chirp in
+// ascending ID order.
+type ChirpQuery struct {
+	// AuthorIDs limits the results to chirps by these users. Empty means
+	// any author.
+	AuthorIDs []int
+	// MinID and MaxID bound the chirp IDs, inclusively. Zero means no bound.
+	MinID int
+	MaxID int
+	// Since and Until bound CreatedAt. Since is inclusive and Until
+	// exclusive. The zero time means no bound.
+	Since  time.Time
+	Until  time.Time
+	SortBy SortKey
+	Order  SortOrder
+	// Limit caps the number of chirps returned. Zero means no limit.
+	Limit int
+	// Cursor continues a previous query from its ChirpPage.Next or Prev.
+	// The other fields should be the same as in that query.
+	Cursor string
+}
+
+// ChirpPage is one page of results from QueryChirps.
+type ChirpPage struct {
+	Chirps []Chirp
+	// Next and Prev are cursors for the following and preceding pages, or
+	// empty at either end.
+	Next string
+	Prev string
+}
+
+// chirpCursor marks where a page starts: just past the chirp After, or,
+// going backwards, just before the chirp Before, in the query's order. At
+// is that chirp's CreatedAt when sorting by time. Cursors are positions
+// rather than offsets, so pages don't shift when new chirps are added. They
+// are encoded into an opaque string, so clients can't come to depend on what
+// is inside.
+type chirpCursor struct {
+	After  int        `json:"after,omitempty"`
+	Before int        `json:"before,omitempty"`
+	At     *time.Time `json:"at,omitempty"`
+}
+
+func encodeChirpCursor(c chirpCursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeChirpCursor(s string) (chirpCursor, error) {
+	c := chirpCursor{}
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(raw, &c)
+	}
+	if err != nil || (c.After == 0) == (c.Before == 0) {
+		return c, fmt.Errorf("Malformed cursor: %w", ErrInvalidQuery)
+	}
+	return c, nil
+}
+
+// chirpKey is a chirp's position in a sorted list. When sorting by ID, at
+// is left zero.
+type chirpKey struct {
+	at time.Time
+	id int
+}
+
+func timeKey(chirp Chirp) chirpKey {
+	return chirpKey{at: chirp.CreatedAt, id: chirp.Id}
+}
+
+func compareKeys(a, b chirpKey) int {
+	if c := a.at.Compare(b.at); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.id, b.id)
+}
+
+// chirpList is a list of chirps in ascending key order, so the ID indexes
+// and the time index can be paged through the same way.
+type chirpList interface {
+	Len() int
+	key(i int) chirpKey
+	slice(i, j int) chirpList
+	// filter returns a new list of the chirps keep accepts.
+	filter(keep func(id int) bool) chirpList
+}
+
+type idList []int
+
+func (l idList) Len() int                 { return len(l) }
+func (l idList) key(i int) chirpKey       { return chirpKey{id: l[i]} }
+func (l idList) slice(i, j int) chirpList { return l[i:j] }
+
+func (l idList) filter(keep func(id int) bool) chirpList {
+	kept := idList{}
+	for _, id := range l {
+		if keep(id) {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+type keyList []chirpKey
+
+func (l keyList) Len() int                 { return len(l) }
+func (l keyList) key(i int) chirpKey       { return l[i] }
+func (l keyList) slice(i, j int) chirpList { return l[i:j] }
+
+func (l keyList) filter(keep func(id int) bool) chirpList {
+	kept := keyList{}
+	for _, k := range l {
+		if keep(k.id) {
+			kept = append(kept, k)
+		}
+	}
+	return kept
+}
+
+// searchList returns the index of the first chirp in l at or after k.
+func searchList(l chirpList, k chirpKey) int {
+	return sort.Search(l.Len(), func(i int) bool {
+		return compareKeys(l.key(i), k) >= 0
+	})
+}
+
+// afterKey is the smallest key greater than k.
+func afterKey(k chirpKey) chirpKey {
+	return chirpKey{at: k.at, id: k.id + 1}
+}
+
+// QueryChirps returns the chirps matching q. It works from the ID and time
+// indexes, so only the chirps on the returned page are read, unless q has
+// bounds on the key it doesn't sort by, which need a scan.
+func (tx *Tx) QueryChirps(q ChirpQuery) (ChirpPage, error) {
+	if q.Limit < 0 || q.MinID < 0 || q.MaxID < 0 {
+		return ChirpPage{}, fmt.Errorf("Limit and ID bounds can't be negative: %w", ErrInvalidQuery)
+	}
+	cursor := chirpCursor{}
+	if q.Cursor != "" {
+		var err error
+		cursor, err = decodeChirpCursor(q.Cursor)
+		if err != nil {
+			return ChirpPage{}, err
+		}
+	}
+	byTime := q.SortBy == SortByTime
+
+	inIDRange := func(id int) bool {
+		return id >= q.MinID && (q.MaxID == 0 || id <= q.MaxID)
+	}
+	inTimeRange := func(id int) bool {
+		createdAt := tx.data.Chirps[id].CreatedAt
+		return !createdAt.Before(q.Since) && (q.Until.IsZero() || createdAt.Before(q.Until))
+	}
+	var list chirpList
+	if byTime {
+		list = tx.chirpKeysByAuthors(q.AuthorIDs)
+		start := searchList(list, chirpKey{at: q.Since})
+		end := list.Len()
+		if !q.Until.IsZero() {
+			end = searchList(list, chirpKey{at: q.Until})
+		}
+		list = list.slice(start, max(start, end))
+		if q.MinID != 0 || q.MaxID != 0 {
+			list = list.filter(inIDRange)
+		}
+	} else {
+		list = idList(tx.chirpIDsByAuthors(q.AuthorIDs))
+		start := searchList(list, chirpKey{id: q.MinID})
+		end := list.Len()
+		if q.MaxID != 0 {
+			end = searchList(list, chirpKey{id: q.MaxID + 1})
+		}
+		list = list.slice(start, max(start, end))
+		if !q.Since.IsZero() || !q.Until.IsZero() {
+			list = list.filter(inTimeRange)
+		}
+	}
+
+	n := list.Len()
+	if q.Limit > 0 {
+		n = q.Limit
+	}
+	// The page is list[lo:hi], which is reversed for a descending query.
+	// Work out where it sits in ascending order: after the cursor when
+	// reading forwards, before it when reading backwards.
+	var lo, hi int
+	desc := q.Order == SortDesc
+	at := chirpKey{}
+	if byTime && cursor.At != nil {
+		at.at = *cursor.At
+	}
+	switch {
+	case cursor.After != 0 && !desc:
+		at.id = cursor.After
+		lo = searchList(list, afterKey(at))
+		hi = min(list.Len(), lo+n)
+	case cursor.Before != 0 && desc:
+		at.id = cursor.Before
+		lo = searchList(list, afterKey(at))
+		hi = min(list.Len(), lo+n)
+	case cursor.Before != 0:
+		at.id = cursor.Before
+		hi = searchList(list, at)
+		lo = max(0, hi-n)
+	case cursor.After != 0:
+		at.id = cursor.After
+		hi = searchList(list, at)
+		lo = max(0, hi-n)
+	case desc:
+		hi = list.Len()
+		lo = max(0, hi-n)
+	default:
+		hi = min(list.Len(), n)
+	}
+
+	page := ChirpPage{Chirps: make([]Chirp, 0, hi-lo)}
+	for i := lo; i < hi; i++ {
+		page.Chirps = append(page.Chirps, tx.data.Chirps[list.key(i).id])
+	}
+	if len(page.Chirps) == 0 {
+		return page, nil
+	}
+	first, last := page.Chirps[0], page.Chirps[len(page.Chirps)-1]
+	hasPrev, hasNext := lo > 0, hi < list.Len()
+	if desc {
+		slices.Reverse(page.Chirps)
+		first, last = last, first
+		hasPrev, hasNext = hasNext, hasPrev
+	}
+	if hasNext {
+		page.Next = encodeChirpCursor(chirpCursor{After: last.Id, At: cursorTime(byTime, last)})
+	}
+	if hasPrev {
+		page.Prev = encodeChirpCursor(chirpCursor{Before: first.Id, At: cursorTime(byTime, first)})
+	}
+	return page, nil
+}
+
+func cursorTime(byTime bool, chirp Chirp) *time.Time {
+	if !byTime {
+		return nil
+	}
+	return &chirp.CreatedAt
+}
+
+// chirpIDsByAuthors returns the IDs of the chirps by authorIDs, or of every
+// chirp if authorIDs is empty, in ascending order. The result may share
+// memory with the indexes and must not be modified.
+func (tx *Tx) chirpIDsByAuthors(authorIDs []int) []int {
+	idx := tx.data.idx
+	switch len(authorIDs) {
+	case 0:
+		return idx.chirpIDs
+	case 1:
+		return idx.chirpsByAuthor[authorIDs[0]]
+	}
+	authors := slices.Clone(authorIDs)
+	slices.Sort(authors)
+	authors = slices.Compact(authors)
+	ids := []int{}
+	for _, authorID := range authors {
+		ids = append(ids, idx.chirpsByAuthor[authorID]...)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// chirpKeysByAuthors is chirpIDsByAuthors in time order. Without an author
+// filter it is the time index itself; otherwise the authors' chirps are
+// sorted by time on the fly.
+func (tx *Tx) chirpKeysByAuthors(authorIDs []int) keyList {
+	if len(authorIDs) == 0 {
+		return tx.data.idx.chirpsByTime
+	}
+	ids := tx.chirpIDsByAuthors(authorIDs)
+	keys := make(keyList, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, timeKey(tx.data.Chirps[id]))
+	}
+	slices.SortFunc(keys, compareKeys)
+	return keys
+}
@@ -0,0 +1,195 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+var queryBase = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// addChirpAt creates a chirp and moves its CreatedAt to minute minutes past
+// queryBase, so time order can differ from ID order.
+func addChirpAt(t *testing.T, s Store, minute int) Chirp {
+	t.Helper()
+	var chirp Chirp
+	err := s.Update(func(tx *Tx) error {
+		var err error
+		chirp, err = tx.CreateChirp(fmt.Sprintf("chirp at %d", minute), 1)
+		if err != nil {
+			return err
+		}
+		chirp.CreatedAt = queryBase.Add(time.Duration(minute) * time.Minute)
+		chirp = tx.putChirp(chirp)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chirp
+}
+
+// sortedIDs returns the IDs of chirps in the order q sorts them.
+func sortedIDs(chirps []Chirp, q ChirpQuery) []int {
+	sorted := slices.Clone(chirps)
+	slices.SortFunc(sorted, func(a, b Chirp) int {
+		c := compareKeys(chirpKey{id: a.Id}, chirpKey{id: b.Id})
+		if q.SortBy == SortByTime {
+			c = compareKeys(timeKey(a), timeKey(b))
+		}
+		if q.Order == SortDesc {
+			c = -c
+		}
+		return c
+	})
+	ids := []int{}
+	for _, chirp := range sorted {
+		ids = append(ids, chirp.Id)
+	}
+	return ids
+}
+
+func pageIDs(page ChirpPage) []int {
+	ids := []int{}
+	for _, chirp := range page.Chirps {
+		ids = append(ids, chirp.Id)
+	}
+	return ids
+}
+
+var queryOrders = []struct {
+	name string
+	q    ChirpQuery
+}{
+	{"id asc", ChirpQuery{SortBy: SortByID, Order: SortAsc}},
+	{"id desc", ChirpQuery{SortBy: SortByID, Order: SortDesc}},
+	{"time asc", ChirpQuery{SortBy: SortByTime, Order: SortAsc}},
+	{"time desc", ChirpQuery{SortBy: SortByTime, Order: SortDesc}},
+}
+
+func TestQueryChirpsPages(t *testing.T) {
+	s := NewMemStore(Options{})
+	chirps := []Chirp{}
+	// Out of ID order, with two pairs created at the same minute.
+	for _, minute := range []int{5, 1, 9, 1, 7, 3, 3, 8} {
+		chirps = append(chirps, addChirpAt(t, s, minute))
+	}
+
+	for _, tt := range queryOrders {
+		t.Run(tt.name, func(t *testing.T) {
+			want := sortedIDs(chirps, tt.q)
+			q := tt.q
+			q.Limit = 3
+
+			// Forwards through every page.
+			pages := [][]int{}
+			for {
+				page, err := s.QueryChirps(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(pages) == 0 && page.Prev != "" {
+					t.Error("first page has a prev cursor")
+				}
+				pages = append(pages, pageIDs(page))
+				if page.Next == "" {
+					break
+				}
+				if len(pages) > len(chirps) {
+					t.Fatal("next cursors never ran out")
+				}
+				q.Cursor = page.Next
+			}
+			if got := slices.Concat(pages...); !slices.Equal(got, want) {
+				t.Fatalf("walking next: got %v, want %v", got, want)
+			}
+
+			// And back again from the last page.
+			page, err := s.QueryChirps(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := len(pages) - 2; i >= 0; i-- {
+				if page.Prev == "" {
+					t.Fatalf("page %d has no prev cursor", i+1)
+				}
+				q.Cursor = page.Prev
+				page, err = s.QueryChirps(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := pageIDs(page); !slices.Equal(got, pages[i]) {
+					t.Errorf("walking prev to page %d: got %v, want %v", i, got, pages[i])
+				}
+			}
+			if page.Prev != "" {
+				t.Error("walking prev: first page has a prev cursor")
+			}
+		})
+	}
+}
+
+func TestQueryChirpsStableUnderInserts(t *testing.T) {
+	for _, tt := range queryOrders {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemStore(Options{})
+			chirps := []Chirp{}
+			for _, minute := range []int{10, 20, 30, 40, 50, 60} {
+				chirps = append(chirps, addChirpAt(t, s, minute))
+			}
+			original := sortedIDs(chirps, tt.q)
+
+			q := tt.q
+			q.Limit = 2
+			seen := []int{}
+			for round := 0; ; round++ {
+				page, err := s.QueryChirps(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				seen = append(seen, pageIDs(page)...)
+				if page.Next == "" {
+					break
+				}
+				if round > 20 {
+					t.Fatal("next cursors never ran out")
+				}
+				q.Cursor = page.Next
+				// Between the first few requests, add chirps at both ends
+				// and in the middle of the range. New chirps get higher
+				// IDs, so inserting on every request would never let an
+				// ascending ID walk finish.
+				if round < 2 {
+					for _, m := range []int{0, 35, 100} {
+						chirps = append(chirps, addChirpAt(t, s, m))
+					}
+				}
+			}
+
+			// Every page continues exactly where the last one ended, so
+			// nothing is repeated or skipped and the order holds.
+			unique := slices.Clone(seen)
+			slices.Sort(unique)
+			if len(slices.Compact(unique)) != len(seen) {
+				t.Errorf("a chirp was returned twice: %v", seen)
+			}
+			for _, id := range original {
+				if !slices.Contains(seen, id) {
+					t.Errorf("chirp %d was skipped: %v", id, seen)
+				}
+			}
+			byID := map[int]Chirp{}
+			for _, chirp := range chirps {
+				byID[chirp.Id] = chirp
+			}
+			seenChirps := []Chirp{}
+			for _, id := range seen {
+				seenChirps = append(seenChirps, byID[id])
+			}
+			if want := sortedIDs(seenChirps, tt.q); !slices.Equal(seen, want) {
+				t.Errorf("got %v, want them in order %v", seen, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package database
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// textIndex is an inverted index of chirp bodies. It maps each term to the
+// chirps containing it and the positions it appears at, which is what phrase
+// queries need. terms is kept sorted so prefix queries can binary search it.
+type textIndex struct {
+	postings map[string]map[int][]int
+	terms    []string
+}
+
+func newTextIndex() textIndex {
+	return textIndex{postings: make(map[string]map[int][]int)}
+}
+
+// tokenize splits text into lower-case terms made of letters and digits.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func (t *textIndex) add(chirp Chirp) {
+	for _, term := range t.addPostings(chirp) {
+		i, _ := slices.BinarySearch(t.terms, term)
+		t.terms = slices.Insert(t.terms, i, term)
+	}
+}
+
+// addPostings indexes chirp's body and returns the terms that weren't in the
+// index before, without adding them to t.terms.
+func (t *textIndex) addPostings(chirp Chirp) (newTerms []string) {
+	for pos, term := range tokenize(chirp.Body) {
+		chirps, ok := t.postings[term]
+		if !ok {
+			chirps = make(map[int][]int)
+			t.postings[term] = chirps
+			newTerms = append(newTerms, term)
+		}
+		chirps[chirp.Id] = append(chirps[chirp.Id], pos)
+	}
+	return newTerms
+}
+
+func (t *textIndex) remove(chirp Chirp) {
+	for _, term := range tokenize(chirp.Body) {
+		chirps, ok := t.postings[term]
+		if !ok {
+			continue
+		}
+		delete(chirps, chirp.Id)
+		if len(chirps) == 0 {
+			delete(t.postings, term)
+			if i, found := slices.BinarySearch(t.terms, term); found {
+				t.terms = slices.Delete(t.terms, i, i+1)
+			}
+		}
+	}
+}
+
+// termsWithPrefix returns every indexed term starting with prefix.
+func (t *textIndex) termsWithPrefix(prefix string) []string {
+	i, _ := slices.BinarySearch(t.terms, prefix)
+	j := i
+	for j < len(t.terms) && strings.HasPrefix(t.terms[j], prefix) {
+		j++
+	}
+	return t.terms[i:j]
+}
+
+// SearchQuery is a full-text search over chirp bodies. Text is a list of
+// clauses that must all match:
+//
+//	word       the word, in any case
+//	pre*       any word starting with pre
+//	"a phrase" the words next to each other, in this order
+//
+// Results are ranked by relevance, best first.
+type SearchQuery struct {
+	Text string
+	// AuthorIDs limits the results to chirps by these users. Empty means
+	// any author.
+	AuthorIDs []int
+	// Limit caps the number of chirps returned. Zero means no limit.
+	Limit int
+	// Cursor continues a previous search from its ChirpPage.Next or Prev.
+	Cursor string
+}
+
+// searchClause is one parsed part of a SearchQuery. A phrase has several
+// terms; a single word is a phrase of one term.
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+func parseSearch(text string) ([]searchClause, error) {
+	clauses := []searchClause{}
+	for i, part := range strings.Split(text, `"`) {
+		if i%2 == 1 {
+			// Inside quotes.
+			if terms := tokenize(part); len(terms) > 0 {
+				clauses = append(clauses, searchClause{terms: terms})
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			trimmed, prefix := strings.CutSuffix(word, "*")
+			terms := tokenize(trimmed)
+			if len(terms) == 0 {
+				continue
+			}
+			if prefix && len(terms) > 1 {
+				return nil, fmt.Errorf("Prefix %q must be a single word: %w", word, ErrInvalidQuery)
+			}
+			clauses = append(clauses, searchClause{terms: terms, prefix: prefix})
+		}
+	}
+	if strings.Count(text, `"`)%2 == 1 {
+		return nil, fmt.Errorf("Unterminated phrase: %w", ErrInvalidQuery)
+	}
+	if len(clauses) == 0 {
+		return nil, fmt.Errorf("Search has no words: %w", ErrInvalidQuery)
+	}
+	return clauses, nil
+}
+
+// searchCursor is the number of ranked results already returned. Unlike a
+// chirpCursor it is an offset, since results are ordered by score.
+type searchCursor struct {
+	Offset int `json:"offset"`
+}
+
+// SearchChirps returns the chirps matching every clause of q, ranked by
+// TF-IDF: a match counts for more the more often it occurs in the chirp and
+// the rarer its words are overall. Ties go to the newer chirp.
+func (tx *Tx) SearchChirps(q SearchQuery) (ChirpPage, error) {
+	if q.Limit < 0 {
+		return ChirpPage{}, fmt.Errorf("Limit can't be negative: %w", ErrInvalidQuery)
+	}
+	clauses, err := parseSearch(q.Text)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	cursor := searchCursor{}
+	if q.Cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err == nil {
+			err = json.Unmarshal(raw, &cursor)
+		}
+		if err != nil || cursor.Offset < 0 {
+			return ChirpPage{}, fmt.Errorf("Malformed cursor: %w", ErrInvalidQuery)
+		}
+	}
+
+	var scores map[int]float64
+	for _, clause := range clauses {
+		matches := tx.matchClause(clause)
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for id, score := range scores {
+			if match, ok := matches[id]; ok {
+				scores[id] = score + match
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	type result struct {
+		id    int
+		score float64
+	}
+	results := make([]result, 0, len(scores))
+	for id, score := range scores {
+		if len(q.AuthorIDs) > 0 && !slices.Contains(q.AuthorIDs, tx.data.Chirps[id].AuthorID) {
+			continue
+		}
+		results = append(results, result{id, score})
+	}
+	slices.SortFunc(results, func(a, b result) int {
+		if c := cmp.Compare(b.score, a.score); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.id, a.id)
+	})
+
+	lo := min(cursor.Offset, len(results))
+	hi := len(results)
+	if q.Limit > 0 {
+		hi = min(hi, lo+q.Limit)
+	}
+	page := ChirpPage{Chirps: make([]Chirp, 0, hi-lo)}
+	for _, r := range results[lo:hi] {
+		page.Chirps = append(page.Chirps, tx.data.Chirps[r.id])
+	}
+	if hi < len(results) {
+		page.Next = encodeSearchCursor(hi)
+	}
+	if lo > 0 && q.Limit > 0 {
+		page.Prev = encodeSearchCursor(max(0, lo-q.Limit))
+	}
+	return page, nil
+}
+
+func encodeSearchCursor(offset int) string {
+	raw, _ := json.Marshal(searchCursor{Offset: offset})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// matchClause scores every chirp matching clause.
+func (tx *Tx) matchClause(clause searchClause) map[int]float64 {
+	text := &tx.data.idx.text
+	scores := make(map[int]float64)
+	if clause.prefix {
+		for _, term := range text.termsWithPrefix(clause.terms[0]) {
+			idf := tx.idf(term)
+			for id, positions := range text.postings[term] {
+				scores[id] += float64(len(positions)) * idf
+			}
+		}
+		return scores
+	}
+
+	idf := 0.0
+	for _, term := range clause.terms {
+		idf += tx.idf(term)
+	}
+	first := clause.terms[0]
+	for id, positions := range text.postings[first] {
+		occurrences := 0
+		for _, pos := range positions {
+			if tx.phraseAt(clause.terms, id, pos) {
+				occurrences++
+			}
+		}
+		if occurrences > 0 {
+			scores[id] = float64(occurrences) * idf
+		}
+	}
+	return scores
+}
+
+// phraseAt reports whether chirp id has terms at consecutive positions
+// starting at pos.
+func (tx *Tx) phraseAt(terms []string, id int, pos int) bool {
+	for i, term := range terms[1:] {
+		positions := tx.data.idx.text.postings[term][id]
+		if _, found := slices.BinarySearch(positions, pos+i+1); !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (tx *Tx) idf(term string) float64 {
+	matching := len(tx.data.idx.text.postings[term])
+	return math.Log(1 + float64(len(tx.data.Chirps))/float64(max(matching, 1)))
+}
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// searchTestStore holds a few chirps to search, by ID:
+//
+//	1 (user 1) The quick brown fox
+//	2 (user 2) A brown dog and a quick fox
+//	3 (user 1) brown brown brown bread
+//	4 (user 2) Foxes are quick!
+//	5 (user 1) quick brown, deleted
+//	6 (user 3) Nothing to see
+func searchTestStore(t *testing.T) Store {
+	t.Helper()
+	s := NewMemStore(Options{})
+	for _, chirp := range []Chirp{
+		{Body: "The quick brown fox", AuthorID: 1},
+		{Body: "A brown dog and a quick fox", AuthorID: 2},
+		{Body: "brown brown brown bread", AuthorID: 1},
+		{Body: "Foxes are quick!", AuthorID: 2},
+		{Body: "quick brown", AuthorID: 1},
+		{Body: "Nothing to see", AuthorID: 3},
+	} {
+		_, err := s.CreateChirp(chirp.Body, chirp.AuthorID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.DeleteChirpByID(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSearchChirps(t *testing.T) {
+	s := searchTestStore(t)
+	tests := []struct {
+		text    string
+		authors []int
+		want    []int
+	}{
+		{"fox", nil, []int{2, 1}},
+		{"FOX", nil, []int{2, 1}},
+		{"fox*", nil, []int{4, 2, 1}},
+		{"qu* fox", nil, []int{2, 1}},
+		{`"quick brown"`, nil, []int{1}},
+		{`"Brown Fox"`, nil, []int{1}},
+		{`"brown quick"`, nil, []int{}},
+		{`"quick fox" dog`, nil, []int{2}},
+		{"fox*", []int{2}, []int{4, 2}},
+		{"fox*", []int{1, 3}, []int{1}},
+		{"see", []int{1}, []int{}},
+	}
+	for _, tt := range tests {
+		page, err := s.SearchChirps(SearchQuery{Text: tt.text, AuthorIDs: tt.authors})
+		if err != nil {
+			t.Errorf("%s: %v", tt.text, err)
+			continue
+		}
+		if got := pageIDs(page); !slices.Equal(got, tt.want) {
+			t.Errorf("%s by %v: got %v, want %v", tt.text, tt.authors, got, tt.want)
+		}
+	}
+}
+
+func TestSearchChirpsRanking(t *testing.T) {
+	s := searchTestStore(t)
+	_, err := s.CreateChirp("fox", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		text string
+		want []int
+	}{
+		// Chirp 3 says "brown" three times; 2 and 1 tie, the newer first.
+		{"brown", []int{3, 2, 1}},
+		// Only chirp 4 says "foxes", so it outranks the newer chirps that
+		// say the commoner "fox".
+		{"fox*", []int{4, 7, 2, 1}},
+	}
+	for _, tt := range tests {
+		page, err := s.SearchChirps(SearchQuery{Text: tt.text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pageIDs(page); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSearchChirpsPages(t *testing.T) {
+	s := searchTestStore(t)
+	q := SearchQuery{Text: "brown", Limit: 1}
+	pages := [][]int{}
+	prevs := []string{}
+	for {
+		page, err := s.SearchChirps(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, pageIDs(page))
+		prevs = append(prevs, page.Prev)
+		if page.Next == "" {
+			break
+		}
+		q.Cursor = page.Next
+	}
+	if want := [][]int{{3}, {2}, {1}}; !slices.EqualFunc(pages, want, slices.Equal[[]int]) {
+		t.Fatalf("got pages %v, want %v", pages, want)
+	}
+	if prevs[0] != "" {
+		t.Errorf("first page has a Prev cursor")
+	}
+	// Prev from the last page goes back one page.
+	page, err := s.SearchChirps(SearchQuery{Text: "brown", Limit: 1, Cursor: prevs[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pageIDs(page); !slices.Equal(got, []int{2}) {
+		t.Errorf("Prev from the last page: got %v, want [2]", got)
+	}
+}
+
+func TestSearchChirpsInvalid(t *testing.T) {
+	s := searchTestStore(t)
+	for _, q := range []SearchQuery{
+		{Text: ""},
+		{Text: "!!"},
+		{Text: `"quick brown`},
+		{Text: "quick-br*"},
+		{Text: "fox", Limit: -1},
+		{Text: "fox", Cursor: "not a cursor"},
+		{Text: "fox", Cursor: encodeSearchCursor(-1)},
+	} {
+		_, err := s.SearchChirps(q)
+		if !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%+v: got %v, want ErrInvalidQuery", q, err)
+		}
+	}
+}
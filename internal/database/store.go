@@ -0,0 +1,288 @@
+package database
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"time"
+)
+
+// Store is the storage API used by the server. DB keeps everything in a JSON
+// file on disk and MemStore keeps it in memory, which is handy for tests.
+type Store interface {
+	View(fn func(tx *Tx) error) error
+	Update(fn func(tx *Tx) error) error
+	Close() error
+
+	// Backup writes a verified archive of the whole database to dir and
+	// Restore replaces the database with one.
+	Backup(dir string, retain int) (Archive, error)
+	Restore(path string) error
+
+	// Export writes users, chirps and tokens to w as JSONL or CSV, and
+	// Import reads them back in under new IDs.
+	Export(w io.Writer, opts ExportOptions) error
+	Import(r io.Reader, opts ImportOptions) (ImportReport, error)
+
+	// Subscribe and LastEventSeq follow the events published after each
+	// commit, see EventBus.
+	Subscribe(after int64) (*Subscription, error)
+	LastEventSeq() int64
+
+	CreateChirp(body string, userID int) (Chirp, error)
+	GetChirps() ([]Chirp, error)
+	QueryChirps(q ChirpQuery) (ChirpPage, error)
+	SearchChirps(q SearchQuery) (ChirpPage, error)
+	GetChirpByID(chirpID int) (Chirp, error)
+	DeleteChirpByID(chirpID int) error
+	UndeleteChirp(chirpID int, notBefore time.Time) (Chirp, error)
+	PurgeDeletedChirps(cutoff time.Time) (int, error)
+
+	CreateUser(email string, hashedPassword []byte) (User, error)
+	GetUsers() ([]User, error)
+	GetUserByID(userID int) (User, error)
+	GetUserByEmail(email string) (User, error)
+	UpdateUser(user User) (User, error)
+
+	CreateRefreshToken(token string, rToken RefreshToken) (RefreshToken, error)
+	GetRefreshToken(token string) (RefreshToken, error)
+	DeleteRefreshToken(token string) error
+	RevokeRefreshTokenFamily(familyID string) (int, error)
+	PurgeExpiredRefreshTokens(now time.Time) (int, error)
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*MemStore)(nil)
+)
+
+// txStore implements the single-operation Store methods on top of a View and
+// Update pair, so every backend gets them by embedding it.
+type txStore struct {
+	view   func(fn func(tx *Tx) error) error
+	update func(fn func(tx *Tx) error) error
+}
+
+func (s txStore) CreateChirp(body string, userID int) (Chirp, error) {
+	var chirp Chirp
+	err := s.update(func(tx *Tx) error {
+		var err error
+		chirp, err = tx.CreateChirp(body, userID)
+		return err
+	})
+	return chirp, err
+}
+
+func (s txStore) GetChirps() ([]Chirp, error) {
+	var chirps []Chirp
+	err := s.view(func(tx *Tx) error {
+		var err error
+		chirps, err = tx.GetChirps()
+		return err
+	})
+	return chirps, err
+}
+
+func (s txStore) QueryChirps(q ChirpQuery) (ChirpPage, error) {
+	var page ChirpPage
+	err := s.view(func(tx *Tx) error {
+		var err error
+		page, err = tx.QueryChirps(q)
+		return err
+	})
+	return page, err
+}
+
+func (s txStore) SearchChirps(q SearchQuery) (ChirpPage, error) {
+	var page ChirpPage
+	err := s.view(func(tx *Tx) error {
+		var err error
+		page, err = tx.SearchChirps(q)
+		return err
+	})
+	return page, err
+}
+
+func (s txStore) GetChirpByID(chirpID int) (Chirp, error) {
+	var chirp Chirp
+	err := s.view(func(tx *Tx) error {
+		var err error
+		chirp, err = tx.GetChirpByID(chirpID)
+		return err
+	})
+	return chirp, err
+}
+
+func (s txStore) DeleteChirpByID(chirpID int) error {
+	return s.update(func(tx *Tx) error {
+		return tx.DeleteChirpByID(chirpID)
+	})
+}
+
+func (s txStore) UndeleteChirp(chirpID int, notBefore time.Time) (Chirp, error) {
+	var chirp Chirp
+	err := s.update(func(tx *Tx) error {
+		var err error
+		chirp, err = tx.UndeleteChirp(chirpID, notBefore)
+		return err
+	})
+	return chirp, err
+}
+
+func (s txStore) PurgeDeletedChirps(cutoff time.Time) (int, error) {
+	var purged int
+	err := s.update(func(tx *Tx) error {
+		var err error
+		purged, err = tx.PurgeDeletedChirps(cutoff)
+		return err
+	})
+	return purged, err
+}
+
+func (s txStore) CreateUser(email string, hashedPassword []byte) (User, error) {
+	var user User
+	err := s.update(func(tx *Tx) error {
+		var err error
+		user, err = tx.CreateUser(email, hashedPassword)
+		return err
+	})
+	return user, err
+}
+
+func (s txStore) GetUsers() ([]User, error) {
+	var users []User
+	err := s.view(func(tx *Tx) error {
+		var err error
+		users, err = tx.GetUsers()
+		return err
+	})
+	return users, err
+}
+
+func (s txStore) GetUserByID(userID int) (User, error) {
+	var user User
+	err := s.view(func(tx *Tx) error {
+		var err error
+		user, err = tx.GetUserByID(userID)
+		return err
+	})
+	return user, err
+}
+
+func (s txStore) GetUserByEmail(email string) (User, error) {
+	var user User
+	err := s.view(func(tx *Tx) error {
+		var err error
+		user, err = tx.GetUserByEmail(email)
+		return err
+	})
+	return user, err
+}
+
+func (s txStore) UpdateUser(user User) (User, error) {
+	var newUser User
+	err := s.update(func(tx *Tx) error {
+		var err error
+		newUser, err = tx.UpdateUser(user)
+		return err
+	})
+	return newUser, err
+}
+
+func (s txStore) CreateRefreshToken(token string, rToken RefreshToken) (RefreshToken, error) {
+	var newToken RefreshToken
+	err := s.update(func(tx *Tx) error {
+		var err error
+		newToken, err = tx.CreateRefreshToken(token, rToken)
+		return err
+	})
+	return newToken, err
+}
+
+func (s txStore) GetRefreshToken(token string) (RefreshToken, error) {
+	var rToken RefreshToken
+	err := s.view(func(tx *Tx) error {
+		var err error
+		rToken, err = tx.GetRefreshToken(token)
+		return err
+	})
+	return rToken, err
+}
+
+func (s txStore) DeleteRefreshToken(token string) error {
+	return s.update(func(tx *Tx) error {
+		return tx.DeleteRefreshToken(token)
+	})
+}
+
+func (s txStore) RevokeRefreshTokenFamily(familyID string) (int, error) {
+	var revoked int
+	err := s.update(func(tx *Tx) error {
+		var err error
+		revoked, err = tx.RevokeRefreshTokenFamily(familyID)
+		return err
+	})
+	return revoked, err
+}
+
+func (s txStore) PurgeExpiredRefreshTokens(now time.Time) (int, error) {
+	var purged int
+	err := s.update(func(tx *Tx) error {
+		var err error
+		purged, err = tx.PurgeExpiredRefreshTokens(now)
+		return err
+	})
+	return purged, err
+}
+
+// Export copies the selected records in one View, then writes them to w
+// after it ends, so the export is consistent but a slow reader doesn't hold
+// up anyone else.
+func (s txStore) Export(w io.Writer, opts ExportOptions) error {
+	err := opts.Check()
+	if err != nil {
+		return err
+	}
+	var snap exportSnapshot
+	err = s.view(func(tx *Tx) error {
+		var err error
+		snap, err = tx.snapshotExport(opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	rw, err := NewRecordWriter(w, opts.Format)
+	if err != nil {
+		return err
+	}
+	err = snap.emit(rw.Write)
+	if err != nil {
+		return err
+	}
+	return rw.Flush()
+}
+
+// Import parses all of r before taking the write lock, then imports every
+// valid record in a single Update, so the import is applied as a whole.
+func (s txStore) Import(r io.Reader, opts ImportOptions) (ImportReport, error) {
+	records, bad, err := readRecords(r, opts.Format)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	var report ImportReport
+	err = s.update(func(tx *Tx) error {
+		report = ImportReport{DryRun: opts.DryRun, Errors: slices.Clone(bad)}
+		err := tx.importRecords(records, opts, &report)
+		if err == nil && opts.DryRun {
+			return errDryRun
+		}
+		return err
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return ImportReport{}, err
+	}
+	slices.SortFunc(report.Errors, func(a, b ImportError) int { return a.Line - b.Line })
+	report.Skipped = len(report.Errors)
+	return report, nil
+}
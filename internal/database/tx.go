@@ -0,0 +1,401 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errReadOnlyTx = errors.New("Cannot write in a read-only transaction")
+
+// Tx is the database as seen from inside a single View or Update call. It
+// must not be used after the callback returns.
+type Tx struct {
+	data     *DBStructure
+	writable bool
+	ids      IDScheme
+	// ops are the changes made so far, in order, and undo holds the op that
+	// reverses each of them. events counts the events they queued.
+	ops    []op
+	undo   []op
+	events int
+}
+
+const (
+	opPutChirp    = "put_chirp"
+	opDeleteChirp = "delete_chirp"
+	opPutUser     = "put_user"
+	opDeleteUser  = "delete_user"
+	opPutToken    = "put_token"
+	opDeleteToken = "delete_token"
+)
+
+// op is a single change to a DBStructure. Every write made through a Tx is
+// expressed as an op so it can be appended to the journal and replayed.
+type op struct {
+	Kind  string        `json:"op"`
+	ID    int           `json:"id,omitempty"`
+	Key   string        `json:"key,omitempty"`
+	Chirp *Chirp        `json:"chirp,omitempty"`
+	User  *User         `json:"user,omitempty"`
+	Token *RefreshToken `json:"token,omitempty"`
+	// Expired marks a delete_token op that purged an expired token, as
+	// opposed to revoking a live one.
+	Expired bool `json:"expired,omitempty"`
+}
+
+// apply performs o, keeping the indexes and ID counters in step, and returns
+// the op that undoes it. An empty op means there is nothing to undo. The ID
+// counters are never wound back, so an ID is not reused even if the
+// transaction that took it is rolled back.
+func (dbStructure *DBStructure) apply(o op) op {
+	idx := dbStructure.idx
+	switch o.Kind {
+	case opPutChirp:
+		prev, ok := dbStructure.Chirps[o.Chirp.Id]
+		if ok {
+			idx.removeChirp(prev)
+		}
+		dbStructure.Chirps[o.Chirp.Id] = *o.Chirp
+		idx.addChirp(*o.Chirp)
+		if o.Chirp.Id >= dbStructure.NextChirpID {
+			dbStructure.NextChirpID = o.Chirp.Id + 1
+		}
+		if ok {
+			return op{Kind: opPutChirp, Chirp: &prev}
+		}
+		return op{Kind: opDeleteChirp, ID: o.Chirp.Id}
+	case opDeleteChirp:
+		if prev, ok := dbStructure.Chirps[o.ID]; ok {
+			delete(dbStructure.Chirps, o.ID)
+			idx.removeChirp(prev)
+			return op{Kind: opPutChirp, Chirp: &prev}
+		}
+	case opPutUser:
+		prev, ok := dbStructure.Users[o.User.Id]
+		if ok {
+			idx.removeUser(prev)
+		}
+		dbStructure.Users[o.User.Id] = *o.User
+		idx.addUser(*o.User)
+		if o.User.Id >= dbStructure.NextUserID {
+			dbStructure.NextUserID = o.User.Id + 1
+		}
+		if ok {
+			return op{Kind: opPutUser, User: &prev}
+		}
+		return op{Kind: opDeleteUser, ID: o.User.Id}
+	case opDeleteUser:
+		if prev, ok := dbStructure.Users[o.ID]; ok {
+			delete(dbStructure.Users, o.ID)
+			idx.removeUser(prev)
+			return op{Kind: opPutUser, User: &prev}
+		}
+	case opPutToken:
+		if prev, ok := dbStructure.RefreshTokens[o.Key]; ok {
+			dbStructure.RefreshTokens[o.Key] = *o.Token
+			return op{Kind: opPutToken, Key: o.Key, Token: &prev}
+		}
+		dbStructure.RefreshTokens[o.Key] = *o.Token
+		return op{Kind: opDeleteToken, Key: o.Key}
+	case opDeleteToken:
+		if prev, ok := dbStructure.RefreshTokens[o.Key]; ok {
+			delete(dbStructure.RefreshTokens, o.Key)
+			return op{Kind: opPutToken, Key: o.Key, Token: &prev}
+		}
+	}
+	return op{}
+}
+
+func (tx *Tx) apply(o op) {
+	undo, events := tx.data.applyLogged(o)
+	tx.undo = append(tx.undo, undo)
+	tx.events += events
+	tx.ops = append(tx.ops, o)
+}
+
+// rollback reverts every change made by tx.
+func (tx *Tx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.data.apply(tx.undo[i])
+	}
+	tx.data.pending = tx.data.pending[:len(tx.data.pending)-tx.events]
+	tx.data.EventSeq -= int64(tx.events)
+	tx.ops = nil
+	tx.undo = nil
+	tx.events = 0
+}
+
+func (tx *Tx) CreateChirp(body string, userID int) (Chirp, error) {
+	if !tx.writable {
+		return Chirp{}, errReadOnlyTx
+	}
+	now := time.Now().UTC()
+	id := tx.ids.nextID(tx.data.NextChirpID, now)
+	chirp := Chirp{Id: id, Body: body, AuthorID: userID, CreatedAt: now, UpdatedAt: now}
+	return tx.putChirp(chirp), nil
+}
+
+// GetChirps returns every chirp in ascending ID order.
+func (tx *Tx) GetChirps() ([]Chirp, error) {
+	return tx.chirpsByID(tx.data.idx.chirpIDs), nil
+}
+
+func (tx *Tx) chirpsByID(ids []int) []Chirp {
+	chirps := make([]Chirp, 0, len(ids))
+	for _, id := range ids {
+		chirps = append(chirps, tx.data.Chirps[id])
+	}
+	return chirps
+}
+
+// GetChirpByID returns the chirp with the given ID. A soft-deleted chirp
+// gives an error wrapping ErrGone.
+func (tx *Tx) GetChirpByID(chirpID int) (Chirp, error) {
+	chirp, ok := tx.data.Chirps[chirpID]
+	if !ok {
+		return Chirp{}, fmt.Errorf("Chirp %d: %w", chirpID, ErrNotFound)
+	}
+	if chirp.DeletedAt != nil {
+		return Chirp{}, fmt.Errorf("Chirp %d: %w", chirpID, ErrGone)
+	}
+	return chirp, nil
+}
+
+// DeleteChirpByID soft-deletes a chirp. It disappears from every read but
+// can be brought back with UndeleteChirp until PurgeDeletedChirps removes
+// it for good.
+func (tx *Tx) DeleteChirpByID(chirpID int) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+	chirp, err := tx.GetChirpByID(chirpID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	chirp.DeletedAt = &now
+	chirp.UpdatedAt = now
+	tx.putChirp(chirp)
+	return nil
+}
+
+// UndeleteChirp restores a soft-deleted chirp, as long as it was deleted
+// after notBefore. Restoring a chirp that isn't deleted is a conflict.
+func (tx *Tx) UndeleteChirp(chirpID int, notBefore time.Time) (Chirp, error) {
+	if !tx.writable {
+		return Chirp{}, errReadOnlyTx
+	}
+	chirp, ok := tx.data.Chirps[chirpID]
+	if !ok {
+		return Chirp{}, fmt.Errorf("Chirp %d: %w", chirpID, ErrNotFound)
+	}
+	if chirp.DeletedAt == nil {
+		return Chirp{}, fmt.Errorf("Chirp %d is not deleted: %w", chirpID, ErrConflict)
+	}
+	if chirp.DeletedAt.Before(notBefore) {
+		return Chirp{}, fmt.Errorf("Chirp %d was deleted too long ago to restore: %w", chirpID, ErrGone)
+	}
+	chirp.DeletedAt = nil
+	chirp.UpdatedAt = time.Now().UTC()
+	return tx.putChirp(chirp), nil
+}
+
+// PurgeDeletedChirps permanently removes the chirps soft-deleted before
+// cutoff and reports how many there were.
+func (tx *Tx) PurgeDeletedChirps(cutoff time.Time) (int, error) {
+	if !tx.writable {
+		return 0, errReadOnlyTx
+	}
+	purged := 0
+	for id, chirp := range tx.data.Chirps {
+		if chirp.DeletedAt != nil && chirp.DeletedAt.Before(cutoff) {
+			tx.apply(op{Kind: opDeleteChirp, ID: id})
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// CreateUser adds a user whose password has already been hashed with
+// bcrypt. Hashing is slow on purpose, so it is done before the transaction
+// rather than while holding the database lock.
+func (tx *Tx) CreateUser(email string, hashedPassword []byte) (User, error) {
+	if !tx.writable {
+		return User{}, errReadOnlyTx
+	}
+	_, err := tx.GetUserByEmail(email)
+	if err == nil {
+		return User{}, fmt.Errorf("User with this email already exists: %w", ErrConflict)
+	}
+	now := time.Now().UTC()
+	id := tx.ids.nextID(tx.data.NextUserID, now)
+	user := User{Id: id, Email: email, Password: hashedPassword, CreatedAt: now, UpdatedAt: now}
+	return tx.putUser(user), nil
+}
+
+func (tx *Tx) GetUsers() ([]User, error) {
+	users := []User{}
+	for _, v := range tx.data.Users {
+		users = append(users, v)
+	}
+	return users, nil
+}
+
+func (tx *Tx) GetUserByID(userID int) (User, error) {
+	user, ok := tx.data.Users[userID]
+	if ok {
+		return user, nil
+	}
+	return User{}, fmt.Errorf("User %d: %w", userID, ErrNotFound)
+}
+
+func (tx *Tx) GetUserByEmail(email string) (User, error) {
+	if id, ok := tx.data.idx.userByEmail[email]; ok {
+		return tx.data.Users[id], nil
+	}
+	return User{}, fmt.Errorf("User with email %s: %w", email, ErrNotFound)
+}
+
+// UpdateUser replaces the stored user with the same ID. user must be the
+// current version, as read in this transaction or checked by the caller;
+// a stale copy fails with ErrConflict rather than overwrite a newer one.
+// CreatedAt is kept from the stored record and UpdatedAt is set to now.
+func (tx *Tx) UpdateUser(user User) (User, error) {
+	if !tx.writable {
+		return User{}, errReadOnlyTx
+	}
+	prev, ok := tx.data.Users[user.Id]
+	if !ok {
+		return User{}, fmt.Errorf("User %d: %w", user.Id, ErrNotFound)
+	}
+	if user.Version != prev.Version {
+		return User{}, fmt.Errorf("User %d was changed since version %d: %w", user.Id, user.Version, ErrConflict)
+	}
+	if id, ok := tx.data.idx.userByEmail[user.Email]; ok && id != user.Id {
+		return User{}, fmt.Errorf("User with this email already exists: %w", ErrConflict)
+	}
+	user.CreatedAt = prev.CreatedAt
+	user.UpdatedAt = time.Now().UTC()
+	return tx.putUser(user), nil
+}
+
+// putChirp and putUser store a record as the next version of the one with
+// its ID. Every write to a chirp or user goes through them.
+func (tx *Tx) putChirp(chirp Chirp) Chirp {
+	chirp.Version = tx.data.Chirps[chirp.Id].Version + 1
+	tx.apply(op{Kind: opPutChirp, Chirp: &chirp})
+	return chirp
+}
+
+func (tx *Tx) putUser(user User) User {
+	user.Version = tx.data.Users[user.Id].Version + 1
+	tx.apply(op{Kind: opPutUser, User: &user})
+	return user
+}
+
+// CreateRefreshToken stores rToken as the record for token, under its
+// hash. token itself is not stored.
+func (tx *Tx) CreateRefreshToken(token string, rToken RefreshToken) (RefreshToken, error) {
+	if !tx.writable {
+		return RefreshToken{}, errReadOnlyTx
+	}
+	rToken.Token = ""
+	rToken.TokenHash = HashRefreshToken(token)
+	if _, ok := tx.data.RefreshTokens[rToken.TokenHash]; ok {
+		return RefreshToken{}, fmt.Errorf("Refresh token already exists: %w", ErrConflict)
+	}
+	tx.putToken(rToken)
+	return rToken, nil
+}
+
+func (tx *Tx) putToken(rToken RefreshToken) {
+	tx.apply(op{Kind: opPutToken, Key: rToken.TokenHash, Token: &rToken})
+}
+
+// GetRefreshToken returns the record for token, whether or not it has
+// expired or been rotated; checking that is up to the caller.
+func (tx *Tx) GetRefreshToken(token string) (RefreshToken, error) {
+	if rToken, ok := tx.data.RefreshTokens[HashRefreshToken(token)]; ok {
+		return rToken, nil
+	}
+	return RefreshToken{}, fmt.Errorf("Refresh token: %w", ErrNotFound)
+}
+
+func (tx *Tx) DeleteRefreshToken(token string) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+	tx.apply(op{Kind: opDeleteToken, Key: HashRefreshToken(token)})
+	return nil
+}
+
+// TouchRefreshToken sets the LastUsedAt of the token with hash tokenHash.
+func (tx *Tx) TouchRefreshToken(tokenHash string, usedAt time.Time) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+	stored, ok := tx.data.RefreshTokens[tokenHash]
+	if !ok {
+		return fmt.Errorf("Refresh token: %w", ErrNotFound)
+	}
+	usedAt = usedAt.UTC()
+	stored.LastUsedAt = &usedAt
+	tx.putToken(stored)
+	return nil
+}
+
+// RotateRefreshToken marks prev as used and stores next, the record for
+// token, in its place, in prev's family. prev must be a token that hasn't
+// been rotated already.
+func (tx *Tx) RotateRefreshToken(prev RefreshToken, token string, next RefreshToken) (RefreshToken, error) {
+	if !tx.writable {
+		return RefreshToken{}, errReadOnlyTx
+	}
+	stored, ok := tx.data.RefreshTokens[prev.TokenHash]
+	if !ok {
+		return RefreshToken{}, fmt.Errorf("Refresh token: %w", ErrNotFound)
+	}
+	if stored.RotatedAt != nil {
+		return RefreshToken{}, fmt.Errorf("Refresh token was already rotated: %w", ErrConflict)
+	}
+	now := time.Now().UTC()
+	stored.RotatedAt = &now
+	tx.putToken(stored)
+	next.FamilyID = stored.Family()
+	return tx.CreateRefreshToken(token, next)
+}
+
+// RevokeRefreshTokenFamily deletes every token in a family, rotated or not,
+// and reports how many there were.
+func (tx *Tx) RevokeRefreshTokenFamily(familyID string) (int, error) {
+	if !tx.writable {
+		return 0, errReadOnlyTx
+	}
+	revoked := 0
+	for key, token := range tx.data.RefreshTokens {
+		if token.Family() == familyID {
+			tx.apply(op{Kind: opDeleteToken, Key: key})
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+// PurgeExpiredRefreshTokens deletes the tokens that expired before now,
+// rotated or not, and reports how many there were. An expired token is
+// refused anyway, and a rotated one can no longer be reused once it has
+// expired, so neither is worth keeping.
+func (tx *Tx) PurgeExpiredRefreshTokens(now time.Time) (int, error) {
+	if !tx.writable {
+		return 0, errReadOnlyTx
+	}
+	purged := 0
+	for key, token := range tx.data.RefreshTokens {
+		if token.ExpiresAt.Before(now) {
+			tx.apply(op{Kind: opDeleteToken, Key: key, Expired: true})
+			purged++
+		}
+	}
+	return purged, nil
+}
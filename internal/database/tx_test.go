@@ -0,0 +1,117 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPurgeExpiredRefreshTokens(t *testing.T) {
+	s := NewMemStore(Options{})
+	now := time.Now().UTC()
+	err := s.Update(func(tx *Tx) error {
+		for token, expiresAt := range map[string]time.Time{
+			"live":            now.Add(time.Hour),
+			"expired":         now.Add(-time.Hour),
+			"rotated-live":    now.Add(time.Hour),
+			"rotated-expired": now.Add(-time.Hour),
+		} {
+			_, err := tx.CreateRefreshToken(token, RefreshToken{UserID: 1, CreatedAt: now, ExpiresAt: expiresAt, FamilyID: token})
+			if err != nil {
+				return err
+			}
+		}
+		for _, token := range []string{"rotated-live", "rotated-expired"} {
+			prev, err := tx.GetRefreshToken(token)
+			if err != nil {
+				return err
+			}
+			_, err = tx.RotateRefreshToken(prev, token+"-next", RefreshToken{UserID: 1, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := s.PurgeExpiredRefreshTokens(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Errorf("purged %d tokens, want 2", purged)
+	}
+	for token, wantKept := range map[string]bool{
+		"live":                 true,
+		"expired":              false,
+		"rotated-live":         true,
+		"rotated-expired":      false,
+		"rotated-live-next":    true,
+		"rotated-expired-next": true,
+	} {
+		_, err := s.GetRefreshToken(token)
+		if kept := err == nil; kept != wantKept {
+			t.Errorf("token %s: kept %v, want %v", token, kept, wantKept)
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			t.Errorf("token %s: %v", token, err)
+		}
+	}
+}
+
+func TestUndeleteChirp(t *testing.T) {
+	db, _ := openTestDB(t)
+	for name, s := range map[string]Store{"MemStore": NewMemStore(Options{}), "DB": db} {
+		t.Run(name, func(t *testing.T) {
+			chirp, err := s.CreateChirp("Hello", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = s.UndeleteChirp(chirp.Id, time.Time{})
+			if !errors.Is(err, ErrConflict) {
+				t.Errorf("restoring a live chirp: got %v, want ErrConflict", err)
+			}
+			err = s.DeleteChirpByID(chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = s.UndeleteChirp(chirp.Id, time.Now().Add(time.Hour))
+			if !errors.Is(err, ErrGone) {
+				t.Errorf("restoring after the window: got %v, want ErrGone", err)
+			}
+			// An error after the restore, as when the caller isn't allowed
+			// to make it, rolls it back.
+			errRefused := errors.New("refused")
+			err = s.Update(func(tx *Tx) error {
+				_, err := tx.UndeleteChirp(chirp.Id, time.Time{})
+				if err != nil {
+					return err
+				}
+				return errRefused
+			})
+			if !errors.Is(err, errRefused) {
+				t.Fatalf("got %v, want the refusal", err)
+			}
+			_, err = s.GetChirpByID(chirp.Id)
+			if !errors.Is(err, ErrGone) {
+				t.Errorf("after a rolled back restore: got %v, want ErrGone", err)
+			}
+
+			restored, err := s.UndeleteChirp(chirp.Id, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restored.DeletedAt != nil || restored.Version != chirp.Version+2 {
+				t.Errorf("restored as %+v", restored)
+			}
+			_, err = s.GetChirpByID(chirp.Id)
+			if err != nil {
+				t.Errorf("after restoring: %v", err)
+			}
+		})
+	}
+}
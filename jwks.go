@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is a key pair for signing access tokens, or just the public
+// half for one that only verifies them.
+type signingKey struct {
+	// kid is the key's RFC 7638 thumbprint, so it never needs configuring
+	// and the same key always gets the same ID.
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// tokenKeySet holds the keys for access tokens. signing is nil when no
+// JWT_SIGNING_KEY is set, in which case tokens are signed with HS256 and
+// JWT_SECRET as before.
+type tokenKeySet struct {
+	signing *signingKey
+	byKID   map[string]*signingKey
+	// public is every key in byKID, in configuration order, for the JWKS.
+	public []*signingKey
+}
+
+// tokenKeys loads the access token keys the first time it is called, see
+// loadTokenKeys.
+var tokenKeys = sync.OnceValues(loadTokenKeys)
+
+// loadTokenKeys reads the access token keys from the environment:
+// JWT_SIGNING_KEY is the PEM private key new tokens are signed with, and
+// JWT_VERIFICATION_KEYS is a comma-separated list of further PEM keys,
+// private or public, whose tokens are still accepted. To rotate, list the
+// old key in JWT_VERIFICATION_KEYS, point JWT_SIGNING_KEY at the new one,
+// and drop the old key once its tokens have expired. Ed25519 keys sign with
+// EdDSA and RSA keys with RS256.
+func loadTokenKeys() (*tokenKeySet, error) {
+	keys := tokenKeySet{byKID: make(map[string]*signingKey)}
+	add := func(path string) (*signingKey, error) {
+		key, err := loadSigningKey(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := keys.byKID[key.kid]; !ok {
+			keys.byKID[key.kid] = key
+			keys.public = append(keys.public, key)
+		}
+		return key, nil
+	}
+	if path := os.Getenv("JWT_SIGNING_KEY"); path != "" {
+		key, err := add(path)
+		if err != nil {
+			return nil, err
+		}
+		if key.private == nil {
+			return nil, fmt.Errorf("JWT_SIGNING_KEY %s is a public key", path)
+		}
+		keys.signing = key
+	}
+	for _, path := range verificationKeyPaths() {
+		_, err := add(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &keys, nil
+}
+
+// verificationKeyPaths splits JWT_VERIFICATION_KEYS into its paths.
+func verificationKeyPaths() []string {
+	paths := []string{}
+	for _, path := range strings.Split(os.Getenv("JWT_VERIFICATION_KEYS"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// keyFilePaths lists every key file configured for access tokens, so the
+// /app/ file server can refuse to hand them out.
+func keyFilePaths() []string {
+	paths := verificationKeyPaths()
+	if path := os.Getenv("JWT_SIGNING_KEY"); path != "" {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// loadSigningKey reads a PEM file holding a PKCS #8 or PKCS #1 private key
+// or a PKIX public key.
+func loadSigningKey(path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s holds an unsupported %q block", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Parsing %s: %w", path, err)
+	}
+	key := signingKey{}
+	if signer, ok := parsed.(crypto.Signer); ok {
+		key.private = signer
+		parsed = signer.Public()
+	}
+	switch public := parsed.(type) {
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+		key.public = public
+	case *rsa.PublicKey:
+		if public.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("%s is a %d-bit RSA key; at least 2048 bits are needed", path, public.N.BitLen())
+		}
+		key.method = jwt.SigningMethodRS256
+		key.public = public
+	default:
+		return nil, fmt.Errorf("%s is a %T, only Ed25519 and RSA keys are supported", path, parsed)
+	}
+	thumbprint, err := json.Marshal(key.jwk().thumbprintMembers())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(thumbprint)
+	key.kid = base64.RawURLEncoding.EncodeToString(sum[:])
+	return &key, nil
+}
+
+// jwk is a public key in JSON Web Key form, RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// Crv and X are set for Ed25519 keys, N and E for RSA keys.
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+func (key *signingKey) jwk() jwk {
+	k := jwk{Kid: key.kid, Use: "sig", Alg: key.method.Alg()}
+	switch public := key.public.(type) {
+	case ed25519.PublicKey:
+		k.Kty, k.Crv, k.X = "OKP", "Ed25519", base64.RawURLEncoding.EncodeToString(public)
+	case *rsa.PublicKey:
+		k.Kty = "RSA"
+		k.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		k.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	}
+	return k
+}
+
+// thumbprintMembers returns the members RFC 7638 hashes for a thumbprint.
+// Maps marshal with sorted keys, which is the order it requires.
+func (k jwk) thumbprintMembers() map[string]string {
+	if k.Kty == "OKP" {
+		return map[string]string{"crv": k.Crv, "kty": k.Kty, "x": k.X}
+	}
+	return map[string]string{"e": k.E, "kty": k.Kty, "n": k.N}
+}
+
+// verificationKey is the jwt.Keyfunc for access tokens. A token with a kid
+// must be signed by that key, using its algorithm. One without is an HS256
+// token, accepted while JWT_SECRET is set; unset it once every service has
+// moved to the public keys.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	keys, err := tokenKeys()
+	if err != nil {
+		return nil, err
+	}
+	kid, hasKID := token.Header["kid"].(string)
+	if !hasKID {
+		secret := os.Getenv("JWT_SECRET")
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok || secret == "" {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(secret), nil
+	}
+	key, ok := keys.byKID[kid]
+	if !ok {
+		return nil, fmt.Errorf("Unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("Key %q doesn't sign with %v", kid, token.Header["alg"])
+	}
+	return key.public, nil
+}
+
+// handleJWKS publishes the public keys access tokens are signed with, so
+// other services can verify them without sharing a secret.
+func handleJWKS(w http.ResponseWriter, r *http.Request) {
+	keys, err := tokenKeys()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+	type jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	set := jwks{Keys: []jwk{}}
+	for _, key := range keys.public {
+		set.Keys = append(set.Keys, key.jwk())
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, 200, set)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"internal/database"
+)
+
+// writePEM writes key to a PEM file in dir: PKCS #8 for a private key, PKIX
+// for a public one.
+func writePEM(t *testing.T, dir, name string, key any) string {
+	t.Helper()
+	block := pem.Block{Type: "PUBLIC KEY"}
+	var err error
+	if _, private := key.(crypto.Signer); private {
+		block.Type = "PRIVATE KEY"
+		block.Bytes, err = x509.MarshalPKCS8PrivateKey(key)
+	} else {
+		block.Bytes, err = x509.MarshalPKIXPublicKey(key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	err = os.WriteFile(path, pem.EncodeToMemory(&block), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newRSAKey(t *testing.T, bits int) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// useTokenKeys points JWT_SIGNING_KEY and JWT_VERIFICATION_KEYS at the
+// given files and reloads the keys, restoring the cached ones afterwards.
+func useTokenKeys(t *testing.T, signing string, verification ...string) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("JWT_SIGNING_KEY", signing)
+	t.Setenv("JWT_VERIFICATION_KEYS", strings.Join(verification, ","))
+	saved := tokenKeys
+	tokenKeys = sync.OnceValues(loadTokenKeys)
+	t.Cleanup(func() { tokenKeys = saved })
+}
+
+// kidOf returns the kid loadSigningKey gives the key at path.
+func kidOf(t *testing.T, path string) string {
+	t.Helper()
+	key, err := loadSigningKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.kid
+}
+
+// signTestToken signs a valid access token for user 7 with key, using
+// method and naming kid in the header.
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, key crypto.Signer) string {
+	t.Helper()
+	claims := accessClaims{RegisteredClaims: jwt.RegisteredClaims{Issuer: "chirpy", Subject: "7", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	token.Header["typ"] = accessTokenType
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestSignedAccessTokenRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		key  crypto.Signer
+		alg  string
+	}{
+		{"Ed25519", newEd25519Key(t), "EdDSA"},
+		{"RSA", newRSAKey(t, 2048), "RS256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writePEM(t, t.TempDir(), "signing.pem", tt.key)
+			useTokenKeys(t, path)
+
+			signed := newAccessToken(database.User{Id: 7})
+			token, _, err := jwt.NewParser().ParseUnverified(signed, &accessClaims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.Header["alg"] != tt.alg {
+				t.Errorf("alg is %v, want %s", token.Header["alg"], tt.alg)
+			}
+			if kid := kidOf(t, path); token.Header["kid"] != kid {
+				t.Errorf("kid is %v, want %s", token.Header["kid"], kid)
+			}
+			p, err := parseAccessToken(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.UserID != 7 {
+				t.Errorf("got user %d, want 7", p.UserID)
+			}
+		})
+	}
+}
+
+func TestAccessTokenRejectsMismatchedAlgorithm(t *testing.T) {
+	dir := t.TempDir()
+	edKey, rsaKey := newEd25519Key(t), newRSAKey(t, 2048)
+	edPath := writePEM(t, dir, "ed25519.pem", edKey)
+	rsaPath := writePEM(t, dir, "rsa.pem", rsaKey)
+	useTokenKeys(t, edPath, rsaPath)
+
+	tokens := map[string]string{
+		"EdDSA naming the RSA key":     signTestToken(t, jwt.SigningMethodEdDSA, kidOf(t, rsaPath), edKey),
+		"RS256 naming the Ed25519 key": signTestToken(t, jwt.SigningMethodRS256, kidOf(t, edPath), rsaKey),
+		"unknown kid":                  signTestToken(t, jwt.SigningMethodEdDSA, "unknown", edKey),
+	}
+	for name, signed := range tokens {
+		_, err := parseAccessToken(signed)
+		if err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	// verificationKey refuses the pairing itself, before the signature
+	// check would trip over the key type.
+	for kid, method := range map[string]jwt.SigningMethod{
+		kidOf(t, rsaPath): jwt.SigningMethodEdDSA,
+		kidOf(t, edPath):  jwt.SigningMethodRS256,
+	} {
+		token := &jwt.Token{Method: method, Header: map[string]interface{}{"alg": method.Alg(), "kid": kid}}
+		key, err := verificationKey(token)
+		if err == nil {
+			t.Errorf("%s token naming key %s: got %T, want an error", method.Alg(), kid, key)
+		}
+	}
+	// The same keys are accepted under their own kids.
+	for _, signed := range []string{
+		signTestToken(t, jwt.SigningMethodEdDSA, kidOf(t, edPath), edKey),
+		signTestToken(t, jwt.SigningMethodRS256, kidOf(t, rsaPath), rsaKey),
+	} {
+		_, err := parseAccessToken(signed)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestAccessTokenKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := newEd25519Key(t)
+	oldPath := writePEM(t, dir, "old.pem", oldKey)
+	useTokenKeys(t, oldPath)
+	oldToken := newAccessToken(database.User{Id: 7})
+
+	// The old key stays only as a public key, for verification.
+	oldPublic := writePEM(t, dir, "old.pub.pem", oldKey.Public())
+	newPath := writePEM(t, dir, "new.pem", newRSAKey(t, 2048))
+	useTokenKeys(t, newPath, oldPublic)
+	_, err := parseAccessToken(oldToken)
+	if err != nil {
+		t.Errorf("token signed before rotation: %v", err)
+	}
+	newToken := newAccessToken(database.User{Id: 7})
+	token, _, err := jwt.NewParser().ParseUnverified(newToken, &accessClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := kidOf(t, newPath); token.Header["kid"] != kid {
+		t.Errorf("new token's kid is %v, want %s", token.Header["kid"], kid)
+	}
+
+	// Once the old key is dropped, its tokens are refused.
+	useTokenKeys(t, newPath)
+	_, err = parseAccessToken(oldToken)
+	if err == nil {
+		t.Errorf("token signed with a dropped key was accepted")
+	}
+}
+
+func TestLoadSigningKeyRefusesSmallRSAKeys(t *testing.T) {
+	dir := t.TempDir()
+	key := newRSAKey(t, 1024)
+	for _, path := range []string{
+		writePEM(t, dir, "private.pem", key),
+		writePEM(t, dir, "public.pem", key.Public()),
+	} {
+		_, err := loadSigningKey(path)
+		if err == nil {
+			t.Errorf("%s: 1024-bit key accepted", filepath.Base(path))
+		}
+	}
+}
+
+func TestHandleJWKS(t *testing.T) {
+	dir := t.TempDir()
+	edKey, rsaKey := newEd25519Key(t), newRSAKey(t, 2048)
+	useTokenKeys(t, writePEM(t, dir, "ed25519.pem", edKey), writePEM(t, dir, "rsa.pub.pem", rsaKey.Public()))
+	srv := newTestServer(t)
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	resp := doJSON(t, srv, "GET", "/.well-known/jwks.json", "", nil, &set)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want 200", resp.StatusCode)
+	}
+	if len(set.Keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(set.Keys))
+	}
+
+	ed := set.Keys[0]
+	x := base64.RawURLEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey))
+	if ed.Kty != "OKP" || ed.Crv != "Ed25519" || ed.Alg != "EdDSA" || ed.X != x || ed.N != "" {
+		t.Errorf("got Ed25519 key %+v", ed)
+	}
+	if want := thumbprint(fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, x)); ed.Kid != want {
+		t.Errorf("Ed25519 kid is %s, want thumbprint %s", ed.Kid, want)
+	}
+
+	rs := set.Keys[1]
+	n, err := base64.RawURLEncoding.DecodeString(rs.N)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Kty != "RSA" || rs.Alg != "RS256" || new(big.Int).SetBytes(n).Cmp(rsaKey.N) != 0 || rs.E != "AQAB" || rs.X != "" {
+		t.Errorf("got RSA key %+v", rs)
+	}
+	if want := thumbprint(fmt.Sprintf(`{"e":"AQAB","kty":"RSA","n":"%s"}`, rs.N)); rs.Kid != want {
+		t.Errorf("RSA kid is %s, want thumbprint %s", rs.Kid, want)
+	}
+}
+
+// thumbprint hashes the RFC 7638 members of a JWK, written out by hand.
+func thumbprint(members string) string {
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -1,28 +1,31 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"internal/database"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime/debug"
-	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/joho/godotenv"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type apiConfig struct {
 	fileServerHits int
+	db             database.Store
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.HandlerFunc {
@@ -73,58 +76,75 @@ func respondWithError(w http.ResponseWriter, code int, msg string) {
 	return
 }
 
-func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) error {
-	resp, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
-		w.WriteHeader(500)
-		return errors.New(fmt.Sprintf("Couldn't marshall json %v", payload))
+// errForbidden aborts a transaction when the caller may not make the change.
+var errForbidden = errors.New("Forbidden")
+
+// errPreconditionFailed means an If-Match header named a version other than
+// the current one.
+var errPreconditionFailed = errors.New("Precondition failed")
+
+// etag is the ETag of version of a chirp or user record.
+func etag(version int) string {
+	return fmt.Sprintf(`"v%d"`, version)
+}
+
+// etagMatches reports whether the If-Match or If-None-Match header value
+// lists version, or is "*". Weak tags compare equal to strong ones, since
+// versions identify the record either way.
+func etagMatches(header string, version int) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	w.Write(resp)
-	return nil
+	return false
 }
 
-func newAccessToken(u database.User) (token string) {
-	jwtSecret := os.Getenv("JWT_SECRET")
-	expirationTime := time.Now().Add(time.Hour * time.Duration(1))
-	claims := jwt.RegisteredClaims{Issuer: "chirpy", IssuedAt: jwt.NewNumericDate(time.Now().UTC()), Subject: string(u.Id), ExpiresAt: jwt.NewNumericDate(expirationTime)}
-	tokenObj := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	accessToken, err := tokenObj.SignedString([]byte(jwtSecret))
-	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
+// checkIfMatch fails with errPreconditionFailed if r has an If-Match header
+// that doesn't name version. Call it inside the Update that makes the
+// change, so the check and the write are atomic.
+func checkIfMatch(r *http.Request, version int) error {
+	header := r.Header.Get("If-Match")
+	if header != "" && !etagMatches(header, version) {
+		return fmt.Errorf("Record is at version %d: %w", version, errPreconditionFailed)
 	}
-	return accessToken
+	return nil
 }
 
-func authenticateJWT(r *http.Request) (*jwt.Token, error) {
-	tokenHeader := r.Header.Get("Authorization")
-	tokenString := strings.Replace(tokenHeader, "Bearer ", "", 1)
-	claims := jwt.RegisteredClaims{}
-	tokenObj, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(os.Getenv("JWT_SECRET")), nil
-	})
-	if err != nil {
-		return &jwt.Token{}, err
+// respondWithDBError maps an error from the database package to a status
+// code. Anything unexpected is logged and reported as a 500 without details.
+func respondWithDBError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		respondWithError(w, 404, err.Error())
+	case errors.Is(err, database.ErrConflict):
+		respondWithError(w, 409, err.Error())
+	case errors.Is(err, database.ErrGone):
+		respondWithError(w, 410, err.Error())
+	case errors.Is(err, errForbidden):
+		respondWithError(w, 403, err.Error())
+	case errors.Is(err, errPreconditionFailed):
+		respondWithError(w, 412, err.Error())
+	case errors.Is(err, database.ErrInvalidQuery):
+		respondWithError(w, 400, err.Error())
+	default:
+		log.Println("Database error:", err)
+		respondWithError(w, 500, "Internal server error")
 	}
-	return tokenObj, nil
 }
 
-func getUserIdFromJwtToken(token *jwt.Token) (userID int, err error) {
-	idString, err := token.Claims.GetSubject()
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) error {
+	resp, err := json.Marshal(payload)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return errors.New(fmt.Sprintf("Couldn't marshall json %v", payload))
 	}
-	// var userID int
-	idBytes := []byte(idString)
-	userID = int(idBytes[0])
-	return userID, nil
-
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(resp)
+	return nil
 }
 
 func contains(slice []string, item string) bool {
@@ -151,7 +171,10 @@ func censor_words(source string, wordsToReplace []string) string {
 	return result
 }
 
-func handlePOSTChirp(w http.ResponseWriter, r *http.Request) {
+// maxChirpLength is the longest chirp body accepted, in bytes.
+const maxChirpLength = 140
+
+func (cfg *apiConfig) handlePOSTChirp(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Body string `json:"body"`
 	}
@@ -165,7 +188,7 @@ func handlePOSTChirp(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, 500, err_msg)
 		return
 	}
-	if len(params.Body) > 140 {
+	if len(params.Body) > maxChirpLength {
 		type returnServerError struct {
 			Error string `json:"error"`
 		}
@@ -176,114 +199,161 @@ func handlePOSTChirp(w http.ResponseWriter, r *http.Request) {
 	profanities := []string{"kerfuffle", "sharbert", "fornax"}
 	cleaned_body := censor_words(params.Body, profanities)
 
-	db, err := database.NewDB("database.json")
-	if err != nil {
-		log.Fatal(err)
-	}
-	token, err := authenticateJWT(r)
-	if err != nil {
-		log.Println(err)
-		w.Write([]byte(err.Error()))
-		w.WriteHeader(401)
-		return
-	}
-	stringUserID, err := token.Claims.GetSubject()
+	caller, _ := principalFrom(r.Context())
+	chirp, err := cfg.db.CreateChirp(cleaned_body, caller.UserID)
 	if err != nil {
-		log.Println(err)
-		w.Write([]byte(err.Error()))
-		w.WriteHeader(401)
+		respondWithDBError(w, err)
 		return
 	}
-	userID := int([]byte(stringUserID)[0])
-	chirp, err := db.CreateChirp(cleaned_body, userID)
-	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
-	}
+	w.Header().Set("ETag", etag(chirp.Version))
 	respondWithJSON(w, 201, chirp)
 	return
 }
 
-func handleGETChirps(w http.ResponseWriter, r *http.Request) {
-	db, err := database.NewDB("database.json")
-	if err != nil {
-		log.Fatal(err)
+// maxChirpsLimit caps the limit parameter of GET /api/chirps. Leaving limit
+// out still returns every chirp, as before pagination existed.
+const maxChirpsLimit = 1000
+
+// setPageLinks adds a Link header pointing at the next and previous pages,
+// which are the current request with its cursor replaced.
+func setPageLinks(w http.ResponseWriter, r *http.Request, next, prev string) {
+	links := []string{}
+	for _, link := range []struct{ rel, cursor string }{{"next", next}, {"prev", prev}} {
+		if link.cursor == "" {
+			continue
+		}
+		query := r.URL.Query()
+		query.Set("cursor", link.cursor)
+		links = append(links, fmt.Sprintf("<%s?%s>; rel=%q", r.URL.Path, query.Encode(), link.rel))
 	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+func (cfg *apiConfig) handleGETChirps(w http.ResponseWriter, r *http.Request) {
 	authorIDString := r.URL.Query().Get("author_id")
 	sortTypeString := r.URL.Query().Get("sort")
-	sortType := "asc"
-	if sortTypeString == "desc" {
-		sortType = "desc"
-	}
 
-	chirps, err := db.GetChirps()
-	if err != nil {
-		log.Fatal(err)
+	query := database.ChirpQuery{Order: database.SortAsc}
+	if sortTypeString == "desc" {
+		query.Order = database.SortDesc
 	}
 	if authorIDString != "" {
-		newChirps := []database.Chirp{}
 		authorID, err := strconv.Atoi(authorIDString)
 		if err != nil {
-			log.Fatal(err)
+			respondWithError(w, 400, "Invalid author_id")
 			return
 		}
-		for _, chirp := range chirps {
-			if chirp.AuthorID == authorID {
-				newChirps = append(newChirps, chirp)
-			}
+		query.AuthorIDs = []int{authorID}
+	}
+	for name, field := range map[string]*int{"limit": &query.Limit, "since_id": &query.MinID, "max_id": &query.MaxID} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			respondWithError(w, 400, "Invalid "+name)
+			return
 		}
-		chirps = newChirps
+		*field = n
 	}
-	//asc
-	switch sortType {
-	case "asc":
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].Id < chirps[j].Id
-		})
-	case "desc":
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].Id > chirps[j].Id
-		})
+	if query.Limit > maxChirpsLimit {
+		respondWithError(w, 400, fmt.Sprintf("limit can't be more than %d", maxChirpsLimit))
+		return
 	}
-
-	jsonResp, err := json.Marshal(chirps)
+	if query.MinID != 0 {
+		// since_id is exclusive, MinID inclusive.
+		query.MinID++
+	}
+	for name, field := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			respondWithError(w, 400, "Invalid "+name+", expected an RFC 3339 time")
+			return
+		}
+		*field = t
+	}
+	switch r.URL.Query().Get("sort_by") {
+	case "", "id":
+		query.SortBy = database.SortByID
+	case "created_at":
+		query.SortBy = database.SortByTime
+	default:
+		respondWithError(w, 400, "Invalid sort_by")
+		return
+	}
+	query.Cursor = r.URL.Query().Get("cursor")
+	page, err := cfg.db.QueryChirps(query)
 	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
+		respondWithDBError(w, err)
+		return
 	}
+	setPageLinks(w, r, page.Next, page.Prev)
+	respondWithJSON(w, 200, page.Chirps)
+}
 
-	w.WriteHeader(200)
-	w.Write(jsonResp)
+// searchLimit is the page size of GET /api/chirps/search when the request
+// doesn't give a limit.
+const searchLimit = 20
 
+func (cfg *apiConfig) handleSearchChirps(w http.ResponseWriter, r *http.Request) {
+	query := database.SearchQuery{Text: r.URL.Query().Get("q"), Limit: searchLimit}
+	if query.Text == "" {
+		respondWithError(w, 400, "Missing q")
+		return
+	}
+	if authorIDString := r.URL.Query().Get("author_id"); authorIDString != "" {
+		authorID, err := strconv.Atoi(authorIDString)
+		if err != nil {
+			respondWithError(w, 400, "Invalid author_id")
+			return
+		}
+		query.AuthorIDs = []int{authorID}
+	}
+	if limitString := r.URL.Query().Get("limit"); limitString != "" {
+		limit, err := strconv.Atoi(limitString)
+		if err != nil || limit < 1 || limit > maxChirpsLimit {
+			respondWithError(w, 400, "Invalid limit")
+			return
+		}
+		query.Limit = limit
+	}
+	query.Cursor = r.URL.Query().Get("cursor")
+	page, err := cfg.db.SearchChirps(query)
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+	setPageLinks(w, r, page.Next, page.Prev)
+	respondWithJSON(w, 200, page.Chirps)
 }
 
-func handleGETChirpByID(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) handleGETChirpByID(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
-	}
-	db, err := database.NewDB("database.json")
-	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
+		respondWithError(w, 400, "Invalid chirp ID")
+		return
 	}
-	chirp, err := db.GetChirpByID(id)
+	chirp, err := cfg.db.GetChirpByID(id)
 	if err != nil {
-		w.WriteHeader(404)
+		respondWithDBError(w, err)
 		return
 	}
-	jsonResp, err := json.Marshal(chirp)
-	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
+	w.Header().Set("ETag", etag(chirp.Version))
+	if etagMatches(r.Header.Get("If-None-Match"), chirp.Version) {
+		w.WriteHeader(304)
+		return
 	}
-	w.WriteHeader(200)
-	w.Write(jsonResp)
-
+	respondWithJSON(w, 200, chirp)
 }
 
-func handlePOSTUser(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) handlePOSTUser(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
@@ -297,29 +367,27 @@ func handlePOSTUser(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, 500, err_msg)
 		return
 	}
-	db, err := database.NewDB("database.json")
+	hashedPass, err := bcrypt.GenerateFromPassword([]byte(params.Password), bcrypt.DefaultCost)
 	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
+		respondWithError(w, 400, err.Error())
+		return
 	}
-	user, err := db.CreateUser(params.Email, params.Password)
+	user, err := cfg.db.CreateUser(params.Email, hashedPass)
 	if err != nil {
-		debug.PrintStack()
-		w.WriteHeader(400)
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(err.Error()))
+		respondWithDBError(w, err)
 		return
 	}
 	type responseJSON struct {
 		database.UserDTO
 	}
-	userDto := database.UserDTO{Id: user.Id, Email: user.Email, IsChirpyRed: user.IsChirpyRed}
+	userDto := database.UserDTO{Id: user.Id, Email: user.Email, IsChirpyRed: user.IsChirpyRed, CreatedAt: user.CreatedAt, UpdatedAt: user.UpdatedAt}
 	respJSON := responseJSON{UserDTO: userDto}
+	w.Header().Set("ETag", etag(user.Version))
 	err = respondWithJSON(w, 201, respJSON)
 
 }
 
-func handleLogin(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) handleLogin(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
@@ -334,12 +402,11 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, 500, err_msg)
 		return
 	}
-	db, err := database.NewDB("database.json")
-	if err != nil {
-		debug.PrintStack()
-		log.Fatal()
+	user, err := cfg.db.GetUserByEmail(params.Email)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		respondWithDBError(w, err)
+		return
 	}
-	user, err := db.GetUserByEmail(params.Email)
 	if err != nil {
 		// log.Println(err)
 		w.WriteHeader(400)
@@ -363,15 +430,13 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	accessToken := newAccessToken(user)
-	refreshTokenSource := make([]byte, 10)
-	_, err = rand.Read(refreshTokenSource)
+	refreshToken, rToken := newRefreshToken(r, user.Id)
+	rToken.FamilyID = randomHex(10)
+	_, err = cfg.db.CreateRefreshToken(refreshToken, rToken)
 	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
+		respondWithDBError(w, err)
+		return
 	}
-	refreshTokenString := hex.EncodeToString(refreshTokenSource)
-	rToken := database.RefreshToken{UserID: user.Id, Token: refreshTokenString, CreatedAt: time.Now()}
-	db.CreateRefreshToken(rToken)
 	type responseJSON struct {
 		database.UserDTO
 		AccessToken  string `json:"token"`
@@ -381,8 +446,8 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		debug.PrintStack()
 		log.Fatal(err)
 	}
-	userDto := database.UserDTO{Id: user.Id, Email: user.Email, IsChirpyRed: user.IsChirpyRed}
-	respJSON, err := json.Marshal(responseJSON{UserDTO: userDto, AccessToken: accessToken, RefreshToken: refreshTokenString})
+	userDto := database.UserDTO{Id: user.Id, Email: user.Email, IsChirpyRed: user.IsChirpyRed, CreatedAt: user.CreatedAt, UpdatedAt: user.UpdatedAt}
+	respJSON, err := json.Marshal(responseJSON{UserDTO: userDto, AccessToken: accessToken, RefreshToken: refreshToken})
 	if err != nil {
 		debug.PrintStack()
 		log.Fatal(err)
@@ -392,7 +457,7 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func handlePUTUser(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) handlePUTUser(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
@@ -406,40 +471,29 @@ func handlePUTUser(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, 500, err_msg)
 		return
 	}
-	tokenHeader := r.Header.Get("Authorization")
-	tokenString := strings.Replace(tokenHeader, "Bearer ", "", 1)
-	claims := jwt.RegisteredClaims{}
-	tokenObj, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(os.Getenv("JWT_SECRET")), nil
-	})
-	if err != nil {
-		fmt.Println(err)
-		w.WriteHeader(401)
-		return
-	}
-	stringUserID, err := tokenObj.Claims.GetSubject()
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	userID := int([]byte(stringUserID)[0])
-	db, err := database.NewDB("database.json")
+	caller, _ := principalFrom(r.Context())
+	hashedPass, err := bcrypt.GenerateFromPassword([]byte(params.Password), bcrypt.DefaultCost)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	dbUser, err := db.GetUserByID(int(userID))
+	var newUser database.User
+	err = cfg.db.Update(func(tx *database.Tx) error {
+		user, err := tx.GetUserByID(caller.UserID)
+		if err != nil {
+			return err
+		}
+		err = checkIfMatch(r, user.Version)
+		if err != nil {
+			return err
+		}
+		user.Email = params.Email
+		user.Password = hashedPass
+		newUser, err = tx.UpdateUser(user)
+		return err
+	})
 	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	user := database.User{Id: dbUser.Id, Email: params.Email, Password: []byte(params.Password)}
-	newUser, err := db.UpdateUser(user)
-	if err != nil {
-		fmt.Println(err)
+		respondWithDBError(w, err)
 		return
 	}
 	type responseJSON struct {
@@ -447,112 +501,246 @@ func handlePUTUser(w http.ResponseWriter, r *http.Request) {
 		Email string `json:"email"`
 	}
 	respJSON := responseJSON{Id: newUser.Id, Email: newUser.Email}
+	w.Header().Set("ETag", etag(newUser.Version))
 	respondWithJSON(w, 200, respJSON)
 
 	// fmt.Println(token)
 
 }
 
-func handlePOSTRefresh(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Executing refresh")
-	db, err := database.NewDB("database.json")
+// refreshTokenLifetime is how long a refresh token is valid after it is
+// issued. Each refresh issues a new one, so a session lasts as long as it is
+// used at least this often.
+const refreshTokenLifetime = 60 * 24 * time.Hour
+
+// errTokenReused is returned when a rotated refresh token is presented
+// again; its whole family has been revoked by then.
+var errTokenReused = errors.New("Refresh token was already used; signed out everywhere it was shared")
+
+// useRefreshToken validates a refresh token for refreshing or revoking it,
+// and records that it was used. Presenting a token that was already rotated
+// means it leaked, since the client should only hold the newest one, so the
+// whole family is revoked and reused is true. That isn't returned as an
+// error, which would roll the revocation back; the caller must still refuse
+// the request.
+func useRefreshToken(tx *database.Tx, tokenString string) (token database.RefreshToken, reused bool, err error) {
+	token, err = tx.GetRefreshToken(tokenString)
 	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
+		return database.RefreshToken{}, false, err
 	}
-	tokenHeader := r.Header.Get("Authorization")
-	tokenString := strings.Replace(tokenHeader, "Bearer ", "", 1)
-	token, err := db.GetRefreshToken(tokenString)
+	now := time.Now()
+	err = tx.TouchRefreshToken(token.TokenHash, now)
 	if err != nil {
-		w.WriteHeader(401)
+		return database.RefreshToken{}, false, err
+	}
+	if token.RotatedAt != nil {
+		_, err = tx.RevokeRefreshTokenFamily(token.Family())
+		if err != nil {
+			return database.RefreshToken{}, false, err
+		}
+		log.Printf("Refresh token reuse for user %d; revoked its family", token.UserID)
+		return database.RefreshToken{}, true, nil
+	}
+	if !now.Before(token.ExpiresAt) {
+		return database.RefreshToken{}, false, fmt.Errorf("Refresh token expired: %w", database.ErrNotFound)
+	}
+	return token, false, nil
+}
+
+// handlePOSTRefresh exchanges a refresh token for a new access token and a
+// new refresh token, which replaces the old one.
+func (cfg *apiConfig) handlePOSTRefresh(w http.ResponseWriter, r *http.Request) {
+	tokenString, _ := bearerToken(r)
+	reused := false
+	var user database.User
+	var next string
+	err := cfg.db.Update(func(tx *database.Tx) error {
+		token, used, err := useRefreshToken(tx, tokenString)
+		reused = used
+		if err != nil || reused {
+			return err
+		}
+		user, err = tx.GetUserByID(token.UserID)
+		if err != nil {
+			return err
+		}
+		var nextRecord database.RefreshToken
+		next, nextRecord = newRefreshToken(r, user.Id)
+		_, err = tx.RotateRefreshToken(token, next, nextRecord)
+		return err
+	})
+	if reused {
+		respondWithError(w, 401, errTokenReused.Error())
 		return
 	}
-	now := time.Now()
-	//if more than 60 days then it's expired
-	fmt.Println("Time-diff: ", now.Sub(token.CreatedAt))
-	if now.Sub(token.CreatedAt) > time.Duration(1)*time.Hour*24*60 {
-		w.WriteHeader(401)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, 401, "Invalid refresh token")
 		return
 	}
-	userID := token.UserID
-	user, err := db.GetUserByID(userID)
 	if err != nil {
-		w.WriteHeader(400)
+		respondWithDBError(w, err)
 		return
 	}
 
 	accessToken := newAccessToken(user)
 	type responseJSON struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
-	respJSON := responseJSON{Token: accessToken}
+	respJSON := responseJSON{Token: accessToken, RefreshToken: next}
 	respondWithJSON(w, 200, respJSON)
 
 }
 
-func handlePOSTRevoke(w http.ResponseWriter, r *http.Request) {
-	db, err := database.NewDB("database.json")
-	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
+// handlePOSTRevoke signs out the session a refresh token belongs to, by
+// revoking its whole family.
+func (cfg *apiConfig) handlePOSTRevoke(w http.ResponseWriter, r *http.Request) {
+	tokenString, _ := bearerToken(r)
+	reused := false
+	err := cfg.db.Update(func(tx *database.Tx) error {
+		token, used, err := useRefreshToken(tx, tokenString)
+		reused = used
+		if err != nil || reused {
+			return err
+		}
+		_, err = tx.RevokeRefreshTokenFamily(token.Family())
+		return err
+	})
+	if reused {
+		respondWithError(w, 401, errTokenReused.Error())
+		return
 	}
-	tokenHeader := r.Header.Get("Authorization")
-	tokenString := strings.Replace(tokenHeader, "Bearer ", "", 1)
-	token, err := db.GetRefreshToken(tokenString)
-	if err != nil {
-		respondWithError(w, 401, "No token in db")
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, 401, "Invalid refresh token")
 		return
 	}
-	now := time.Now()
-	//if more than 60 days then it's expired
-	fmt.Println("Time-diff: ", now.Sub(token.CreatedAt))
-	if now.Sub(token.CreatedAt) > time.Duration(1)*time.Hour*24*60 {
-		respondWithError(w, 401, "Token expired")
+	if err != nil {
+		respondWithDBError(w, err)
 		return
 	}
-	db.DeleteRefreshToken(tokenString)
 	w.WriteHeader(204)
 	return
 
 }
 
-func handleDELETEChirpByID(w http.ResponseWriter, r *http.Request) {
-	db, err := database.NewDB("database.json")
+func (cfg *apiConfig) handleDELETEChirpByID(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFrom(r.Context())
+	chirpID, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		log.Fatal()
+		respondWithError(w, 400, "Invalid chirp ID")
+		return
 	}
-	token, err := authenticateJWT(r)
+	err = cfg.db.Update(func(tx *database.Tx) error {
+		chirp, err := tx.GetChirpByID(chirpID)
+		if err != nil {
+			return err
+		}
+		if chirp.AuthorID != caller.UserID {
+			return fmt.Errorf("Only the author can delete a chirp: %w", errForbidden)
+		}
+		err = checkIfMatch(r, chirp.Version)
+		if err != nil {
+			return err
+		}
+		return tx.DeleteChirpByID(chirpID)
+	})
 	if err != nil {
-		respondWithError(w, 403, err.Error())
+		respondWithDBError(w, err)
 		return
 	}
-	fmt.Println(token)
-	userID, err := getUserIdFromJwtToken(token)
-	if err != nil {
-		log.Fatal(err)
+	w.WriteHeader(204)
+	return
+
+}
+
+// handleUndeleteChirp restores a soft-deleted chirp. Its author can do so
+// with their access token, and an admin with ADMIN_API_KEY, until the
+// undelete window has passed. It runs behind optionalAuth, since admins
+// don't send a token.
+func (cfg *apiConfig) handleUndeleteChirp(w http.ResponseWriter, r *http.Request) {
+	admin := isAdmin(r)
+	caller, signedIn := principalFrom(r.Context())
+	if !admin && !signedIn {
+		respondUnauthorized(w, "")
+		return
 	}
-	fmt.Println(userID)
 	chirpID, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		debug.PrintStack()
-		log.Fatal(err)
+		respondWithError(w, 400, "Invalid chirp ID")
+		return
 	}
-	chirp, err := db.GetChirpByID(chirpID)
+	window, _, err := softDeleteSettings()
 	if err != nil {
-		log.Println(err)
+		respondWithError(w, 500, err.Error())
 		return
 	}
-	if chirp.AuthorID != userID {
-		w.WriteHeader(403)
+	var chirp database.Chirp
+	err = cfg.db.Update(func(tx *database.Tx) error {
+		chirp, err = tx.UndeleteChirp(chirpID, time.Now().Add(-window))
+		if err != nil {
+			return err
+		}
+		if !admin && chirp.AuthorID != caller.UserID {
+			// Returning an error rolls the restore back.
+			return fmt.Errorf("Only the author or an admin can restore a chirp: %w", errForbidden)
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithDBError(w, err)
 		return
 	}
-	err = db.DeleteChirpByID(chirpID)
-	w.WriteHeader(204)
-	return
+	w.Header().Set("ETag", etag(chirp.Version))
+	respondWithJSON(w, 200, chirp)
+}
 
+// softDeleteSettings reads how long a deleted chirp can be restored for,
+// from CHIRP_UNDELETE_WINDOW (default 24h), and how long it is kept before
+// being purged, from CHIRP_RETENTION (default 720h).
+func softDeleteSettings() (window, retention time.Duration, err error) {
+	window, retention = 24*time.Hour, 30*24*time.Hour
+	for name, field := range map[string]*time.Duration{"CHIRP_UNDELETE_WINDOW": &window, "CHIRP_RETENTION": &retention} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return 0, 0, fmt.Errorf("Invalid %s %q", name, value)
+		}
+		*field = d
+	}
+	return window, retention, nil
 }
 
-func handlePolkaWebhook(w http.ResponseWriter, r *http.Request) {
+// purgeExpired hard-deletes chirps once they have been soft-deleted for
+// longer than the retention period, and refresh tokens once they have
+// expired, checking every interval until ctx is done.
+func purgeExpired(ctx context.Context, db database.Store, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := db.PurgeDeletedChirps(time.Now().Add(-retention))
+		if err != nil {
+			log.Println("Error purging deleted chirps:", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d deleted chirps", purged)
+		}
+		purged, err = db.PurgeExpiredRefreshTokens(time.Now())
+		if err != nil {
+			log.Println("Error purging expired refresh tokens:", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d expired refresh tokens", purged)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cfg *apiConfig) handlePolkaWebhook(w http.ResponseWriter, r *http.Request) {
 	type requestData struct {
 		UserID int `json:"user_id"`
 	}
@@ -586,46 +774,396 @@ func handlePolkaWebhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	userID := params.Data.UserID
-	db, err := database.NewDB("database.json")
+	err = cfg.db.Update(func(tx *database.Tx) error {
+		user, err := tx.GetUserByID(userID)
+		if err != nil {
+			return err
+		}
+		user.IsChirpyRed = true
+		_, err = tx.UpdateUser(user)
+		return err
+	})
 	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+		respondWithDBError(w, err)
 		return
 	}
-	user, err := db.GetUserByID(userID)
+	w.WriteHeader(204)
+	return
+}
+
+// isAdmin reports whether r carries ADMIN_API_KEY in the same
+// "ApiKey <key>" form Polka uses. Admin endpoints are disabled when no key is
+// configured.
+func isAdmin(r *http.Request) bool {
+	apiKeySecret := os.Getenv("ADMIN_API_KEY")
+	apiKeyRequest, found := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey ")
+	if apiKeySecret == "" || !found {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(apiKeyRequest), []byte(apiKeySecret)) == 1
+}
+
+func (cfg *apiConfig) handleAdminSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+	dir, retain, err := backupSettings()
 	if err != nil {
-		w.WriteHeader(404)
-		w.Write([]byte(err.Error()))
+		respondWithError(w, 500, err.Error())
 		return
 	}
-	user.IsChirpyRed = true
-	db.UpdateUser(user)
-	w.WriteHeader(204)
-	return
+	archive, err := cfg.db.Backup(dir, retain)
+	if err != nil {
+		log.Println("Error writing snapshot:", err)
+		respondWithDBError(w, err)
+		return
+	}
+	respondWithJSON(w, 201, archive)
 }
 
-func main() {
-	serveMux := http.NewServeMux()
-	apiConf := apiConfig{}
-	err := godotenv.Load()
+// handleAdminEvents streams the database's events to an admin as
+// server-sent events. A client resumes where it left off by sending the last
+// event ID it saw, as browsers do when reconnecting, or with ?after=; without
+// either it gets only new events.
+func (cfg *apiConfig) handleAdminEvents(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, 500, "Streaming not supported")
+		return
+	}
+	after := cfg.db.LastEventSeq()
+	for _, value := range []string{r.Header.Get("Last-Event-ID"), r.URL.Query().Get("after")} {
+		if value == "" {
+			continue
+		}
+		seq, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			respondWithError(w, 400, "Invalid event ID")
+			return
+		}
+		after = seq
+		break
+	}
+	sub, err := cfg.db.Subscribe(after)
+	if errors.Is(err, database.ErrEventsExpired) {
+		respondWithError(w, 410, err.Error())
+		return
+	}
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		respondWithDBError(w, err)
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				// Dropped for falling behind; the client reconnects with
+				// Last-Event-ID and catches up.
+				log.Println("Event stream ended:", sub.Err())
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Println("Error marshalling event:", err)
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+// recordKinds splits a comma-separated list of record kinds, as taken by
+// ?kinds= and -kinds. An empty list means every kind.
+func recordKinds(list string) []database.RecordKind {
+	kinds := []database.RecordKind{}
+	for _, kind := range strings.Split(list, ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			kinds = append(kinds, database.RecordKind(strings.TrimSuffix(kind, "s")))
+		}
 	}
-	serveMux.Handle("/app/", http.StripPrefix("/app/", apiConf.middlewareMetricsInc(http.FileServer(http.Dir(".")))))
+	return kinds
+}
+
+// handleAdminExport downloads users, chirps and tokens as ?format=jsonl
+// (the default) or csv. ?kinds= picks some of them, such as
+// ?kinds=users,chirps, and ?passwords=true includes password hashes.
+func (cfg *apiConfig) handleAdminExport(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+	query := r.URL.Query()
+	opts := database.ExportOptions{
+		Format:    database.Format(query.Get("format")),
+		Kinds:     recordKinds(query.Get("kinds")),
+		Passwords: query.Get("passwords") == "true",
+	}
+	if opts.Format == "" {
+		opts.Format = database.FormatJSONL
+	}
+	contentType := "application/x-ndjson"
+	if opts.Format == database.FormatCSV {
+		contentType = "text/csv"
+	}
+	// Check the options before anything is written, so a bad request still
+	// gets an error status.
+	err := opts.Check()
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-export.%s"`, opts.Format))
+	err = cfg.db.Export(w, opts)
+	if err != nil {
+		log.Println("Error exporting:", err)
+	}
+}
+
+// maxImportSize caps the body of an import request.
+const maxImportSize = 64 << 20
+
+// handleAdminImport imports a JSONL or CSV export sent as the request body,
+// with ?format= as for handleAdminExport, and responds with the report.
+// ?dry_run=true only validates, and ?merge_matched_users=true imports the
+// chirps of users that already exist; see database.ImportOptions.
+func (cfg *apiConfig) handleAdminImport(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+	query := r.URL.Query()
+	opts := database.ImportOptions{
+		Format:            database.Format(query.Get("format")),
+		DryRun:            query.Get("dry_run") == "true",
+		MaxBodyLength:     maxChirpLength,
+		MergeMatchedUsers: query.Get("merge_matched_users") == "true",
+	}
+	if opts.Format == "" {
+		opts.Format = database.FormatJSONL
+	}
+	report, err := cfg.db.Import(http.MaxBytesReader(w, r.Body, maxImportSize), opts)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondWithError(w, 413, "Import is too large")
+		return
+	}
+	if err != nil {
+		log.Println("Error importing:", err)
+		respondWithDBError(w, err)
+		return
+	}
+	respondWithJSON(w, 200, report)
+}
+
+// backupSettings reads where archives go, from BACKUP_DIR, and how many are
+// kept, from BACKUP_RETENTION. Zero keeps every archive.
+func backupSettings() (dir string, retain int, err error) {
+	dir = os.Getenv("BACKUP_DIR")
+	if dir == "" {
+		dir = "backups"
+	}
+	retain = 7
+	if value := os.Getenv("BACKUP_RETENTION"); value != "" {
+		retain, err = strconv.Atoi(value)
+		if err != nil || retain < 0 {
+			return "", 0, fmt.Errorf("Invalid BACKUP_RETENTION %q", value)
+		}
+	}
+	return dir, retain, nil
+}
+
+// hidePrivateFiles stops the /app/ file server from handing out files that
+// only the server should read: dotfiles such as .env, which holds the
+// secrets and DB_ENCRYPTION_KEYS, the access token key files, the database
+// with its journal, backup and lock files, and the backup archives, when
+// they live in the directory it serves.
+func hidePrivateFiles(next http.Handler) http.Handler {
+	// Paths are compared in absolute form, since DB_PATH, BACKUP_DIR and the
+	// key files may each be configured either way.
+	dbFile, _ := filepath.Abs(dbPath())
+	backupDir, _, _ := backupSettings()
+	backupDir, _ = filepath.Abs(backupDir)
+	keyFiles := map[string]bool{}
+	for _, path := range keyFilePaths() {
+		abs, err := filepath.Abs(path)
+		if err == nil {
+			keyFiles[abs] = true
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := filepath.Clean(strings.TrimPrefix(r.URL.Path, "/"))
+		abs, err := filepath.Abs(name)
+		if err != nil || keyFiles[abs] || isDotfile(name) || abs == dbFile || strings.HasPrefix(abs, dbFile+".") || abs == backupDir || strings.HasPrefix(abs, backupDir+string(filepath.Separator)) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isDotfile reports whether any element of the slash-separated path name
+// starts with a dot, which also covers everything under .git.
+func isDotfile(name string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if strings.HasPrefix(part, ".") && part != "." {
+			return true
+		}
+	}
+	return false
+}
+
+// dbPath is where the file backend keeps its data, from DB_PATH.
+func dbPath() string {
+	path := os.Getenv("DB_PATH")
+	if path == "" {
+		path = "database.json"
+	}
+	return path
+}
+
+// dbOptions reads the storage settings shared by every backend. ID_SCHEME
+// is "sequence" (the default) or "time" for time-ordered IDs.
+// DB_ENCRYPTION_KEYS turns on encryption at rest; see database.ParseKeyring
+// for its format. DB_CODEC picks the snapshot encoding, see
+// database.CodecByName.
+func dbOptions() (database.Options, error) {
+	opts := database.Options{}
+	switch os.Getenv("ID_SCHEME") {
+	case "", "sequence":
+		opts.IDs = database.IDSequence
+	case "time":
+		opts.IDs = database.IDTimeOrdered
+	default:
+		return opts, fmt.Errorf("Unknown ID_SCHEME %q", os.Getenv("ID_SCHEME"))
+	}
+	keys, err := database.ParseKeyring(os.Getenv("DB_ENCRYPTION_KEYS"))
+	if err != nil {
+		return opts, err
+	}
+	opts.Keys = keys
+	opts.Codec, err = database.CodecByName(os.Getenv("DB_CODEC"))
+	if err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// openStore picks the storage backend from DB_BACKEND ("file" or "memory").
+func openStore() (database.Store, error) {
+	opts, err := dbOptions()
+	if err != nil {
+		return nil, err
+	}
+	switch os.Getenv("DB_BACKEND") {
+	case "", "file":
+		return database.NewDB(dbPath(), opts)
+	case "memory":
+		return database.NewMemStore(opts), nil
+	default:
+		return nil, fmt.Errorf("Unknown DB_BACKEND %q", os.Getenv("DB_BACKEND"))
+	}
+}
+
+// routes registers every endpoint on a new mux.
+func (apiConf *apiConfig) routes() *http.ServeMux {
+	serveMux := http.NewServeMux()
+	serveMux.Handle("/app/", http.StripPrefix("/app/", apiConf.middlewareMetricsInc(hidePrivateFiles(http.FileServer(http.Dir("."))))))
 	serveMux.HandleFunc("GET /api/healthz/", handleReadiness)
+	serveMux.HandleFunc("GET /.well-known/jwks.json", handleJWKS)
 	serveMux.HandleFunc("GET /api/metrics/", apiConf.handleMetrics)
 	serveMux.HandleFunc("/api/reset/", apiConf.handleResetMetrics)
 	serveMux.HandleFunc("/admin/metrics", apiConf.handleAdminMetrics)
-	serveMux.HandleFunc("POST /api/chirps", handlePOSTChirp)
-	serveMux.HandleFunc("GET /api/chirps", handleGETChirps)
-	serveMux.HandleFunc("GET /api/chirps/{id}", handleGETChirpByID)
-	serveMux.HandleFunc("POST /api/users", handlePOSTUser)
-	serveMux.HandleFunc("POST /api/login", handleLogin)
-	serveMux.HandleFunc("PUT /api/users", handlePUTUser)
-	serveMux.HandleFunc("POST /api/refresh", handlePOSTRefresh)
-	serveMux.HandleFunc("POST /api/revoke", handlePOSTRevoke)
-	serveMux.HandleFunc("DELETE /api/chirps/{id}", handleDELETEChirpByID)
-	serveMux.HandleFunc("POST /api/polka/webhooks", handlePolkaWebhook)
-	server := http.Server{Handler: serveMux, Addr: ":8080"}
-	server.ListenAndServe()
+	serveMux.HandleFunc("POST /admin/snapshot", apiConf.handleAdminSnapshot)
+	serveMux.HandleFunc("GET /admin/events", apiConf.handleAdminEvents)
+	serveMux.HandleFunc("GET /admin/export", apiConf.handleAdminExport)
+	serveMux.HandleFunc("POST /admin/import", apiConf.handleAdminImport)
+	serveMux.HandleFunc("POST /api/chirps", requireAuth(apiConf.handlePOSTChirp))
+	serveMux.HandleFunc("GET /api/chirps", apiConf.handleGETChirps)
+	serveMux.HandleFunc("GET /api/chirps/{id}", apiConf.handleGETChirpByID)
+	serveMux.HandleFunc("GET /api/chirps/search", apiConf.handleSearchChirps)
+	serveMux.HandleFunc("POST /api/users", apiConf.handlePOSTUser)
+	serveMux.HandleFunc("POST /api/login", apiConf.handleLogin)
+	serveMux.HandleFunc("PUT /api/users", requireAuth(apiConf.handlePUTUser))
+	serveMux.HandleFunc("POST /api/refresh", apiConf.handlePOSTRefresh)
+	serveMux.HandleFunc("POST /api/revoke", apiConf.handlePOSTRevoke)
+	serveMux.HandleFunc("DELETE /api/chirps/{id}", requireAuth(apiConf.handleDELETEChirpByID))
+	serveMux.HandleFunc("POST /api/chirps/{id}/undelete", optionalAuth(apiConf.handleUndeleteChirp))
+	serveMux.HandleFunc("POST /api/polka/webhooks", apiConf.handlePolkaWebhook)
+	return serveMux
+}
+
+func main() {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading .env file")
+	}
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+	db, err := openStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	apiConf := apiConfig{db: db}
+	_, err = legacySubjectDeadline()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = tokenKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+	window, retention, err := softDeleteSettings()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if retention < window {
+		log.Printf("CHIRP_RETENTION (%v) is shorter than CHIRP_UNDELETE_WINDOW (%v); some chirps will be purged while they could still be restored", retention, window)
+	}
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	purgeDone := make(chan struct{})
+	go func() {
+		purgeExpired(purgeCtx, db, retention, time.Hour)
+		close(purgeDone)
+	}()
+	// Requests get a context that is cancelled on shutdown, so long-lived
+	// event streams end instead of holding it up.
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	server := http.Server{Handler: apiConf.routes(), Addr: ":8080", BaseContext: func(net.Listener) context.Context { return baseCtx }}
+	server.RegisterOnShutdown(cancelRequests)
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// Shut down cleanly on Ctrl-C so the database writes a final snapshot.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	stopPurge()
+	<-purgeDone
+	err = db.Close()
+	if err != nil {
+		log.Println("Error closing database:", err)
+	}
 }
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"internal/database"
+)
+
+// newTestServer serves the API from a fresh MemStore, so tests never touch
+// database.json.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test-secret")
+	apiConf := apiConfig{db: database.NewMemStore(database.Options{})}
+	srv := httptest.NewServer(apiConf.routes())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// doJSON sends body as JSON, with token as a bearer token when it isn't
+// empty, and decodes the response into out when out isn't nil.
+func doJSON(t *testing.T, srv *httptest.Server, method, path, token string, body, out any) *http.Response {
+	t.Helper()
+	return doJSONWithHeader(t, srv, method, path, token, nil, body, out)
+}
+
+// doJSONWithHeader is doJSON with extra request headers.
+func doJSONWithHeader(t *testing.T, srv *httptest.Server, method, path, token string, header http.Header, body, out any) *http.Response {
+	t.Helper()
+	var reqBody bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&reqBody).Encode(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, srv.URL+path, &reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			t.Fatalf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+	return resp
+}
+
+type loginResponse struct {
+	Id           int    `json:"id"`
+	Email        string `json:"email"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// signUp creates a user and logs them in.
+func signUp(t *testing.T, srv *httptest.Server, email string) loginResponse {
+	t.Helper()
+	creds := map[string]string{"email": email, "password": "hunter2"}
+	resp := doJSON(t, srv, "POST", "/api/users", "", creds, nil)
+	if resp.StatusCode != 201 {
+		t.Fatalf("POST /api/users: got %d, want 201", resp.StatusCode)
+	}
+	login := loginResponse{}
+	resp = doJSON(t, srv, "POST", "/api/login", "", creds, &login)
+	if resp.StatusCode != 200 {
+		t.Fatalf("POST /api/login: got %d, want 200", resp.StatusCode)
+	}
+	if login.Token == "" || login.RefreshToken == "" {
+		t.Fatalf("POST /api/login: missing tokens in %+v", login)
+	}
+	return login
+}
+
+func TestUserAndChirpLifecycle(t *testing.T) {
+	srv := newTestServer(t)
+	alice := signUp(t, srv, "alice@example.com")
+
+	chirp := database.Chirp{}
+	resp := doJSON(t, srv, "POST", "/api/chirps", alice.Token, map[string]string{"body": "what a kerfuffle"}, &chirp)
+	if resp.StatusCode != 201 {
+		t.Fatalf("POST /api/chirps: got %d, want 201", resp.StatusCode)
+	}
+	if chirp.AuthorID != alice.Id || chirp.Body != "what a ****" {
+		t.Errorf("POST /api/chirps: got %+v", chirp)
+	}
+
+	got := database.Chirp{}
+	resp = doJSON(t, srv, "GET", fmt.Sprintf("/api/chirps/%d", chirp.Id), "", nil, &got)
+	if resp.StatusCode != 200 || got.Body != chirp.Body {
+		t.Errorf("GET /api/chirps/%d: got %d %+v", chirp.Id, resp.StatusCode, got)
+	}
+
+	chirps := []database.Chirp{}
+	resp = doJSON(t, srv, "GET", "/api/chirps", "", nil, &chirps)
+	if resp.StatusCode != 200 || len(chirps) != 1 {
+		t.Errorf("GET /api/chirps: got %d with %d chirps", resp.StatusCode, len(chirps))
+	}
+
+	bob := signUp(t, srv, "bob@example.com")
+	resp = doJSON(t, srv, "DELETE", fmt.Sprintf("/api/chirps/%d", chirp.Id), bob.Token, nil, nil)
+	if resp.StatusCode != 403 {
+		t.Errorf("DELETE by another user: got %d, want 403", resp.StatusCode)
+	}
+	resp = doJSON(t, srv, "DELETE", fmt.Sprintf("/api/chirps/%d", chirp.Id), alice.Token, nil, nil)
+	if resp.StatusCode != 204 {
+		t.Errorf("DELETE by the author: got %d, want 204", resp.StatusCode)
+	}
+	resp = doJSON(t, srv, "GET", fmt.Sprintf("/api/chirps/%d", chirp.Id), "", nil, nil)
+	if resp.StatusCode != 410 {
+		t.Errorf("GET deleted chirp: got %d, want 410", resp.StatusCode)
+	}
+}
+
+func TestCreateUserTwice(t *testing.T) {
+	srv := newTestServer(t)
+	signUp(t, srv, "alice@example.com")
+	creds := map[string]string{"email": "alice@example.com", "password": "other"}
+	resp := doJSON(t, srv, "POST", "/api/users", "", creds, nil)
+	if resp.StatusCode != 409 {
+		t.Errorf("got %d, want 409", resp.StatusCode)
+	}
+}
+
+func TestLoginWrongPassword(t *testing.T) {
+	srv := newTestServer(t)
+	signUp(t, srv, "alice@example.com")
+	creds := map[string]string{"email": "alice@example.com", "password": "wrong"}
+	resp := doJSON(t, srv, "POST", "/api/login", "", creds, nil)
+	if resp.StatusCode != 401 {
+		t.Errorf("got %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestChirpTooLong(t *testing.T) {
+	srv := newTestServer(t)
+	alice := signUp(t, srv, "alice@example.com")
+	body := map[string]string{"body": string(bytes.Repeat([]byte("a"), maxChirpLength+1))}
+	resp := doJSON(t, srv, "POST", "/api/chirps", alice.Token, body, nil)
+	if resp.StatusCode != 400 {
+		t.Errorf("got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	srv := newTestServer(t)
+	tests := []struct {
+		name, method, path, token string
+	}{
+		{"post chirp without token", "POST", "/api/chirps", ""},
+		{"post chirp with bad token", "POST", "/api/chirps", "not-a-jwt"},
+		{"update user without token", "PUT", "/api/users", ""},
+		{"delete chirp without token", "DELETE", "/api/chirps/1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := doJSON(t, srv, tt.method, tt.path, tt.token, map[string]string{"body": "hi"}, nil)
+			if resp.StatusCode != 401 {
+				t.Errorf("got %d, want 401", resp.StatusCode)
+			}
+			if resp.Header.Get("WWW-Authenticate") == "" {
+				t.Error("missing WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	srv := newTestServer(t)
+	alice := signUp(t, srv, "alice@example.com")
+
+	refreshed := loginResponse{}
+	resp := doJSON(t, srv, "POST", "/api/refresh", alice.RefreshToken, nil, &refreshed)
+	if resp.StatusCode != 200 || refreshed.Token == "" {
+		t.Fatalf("POST /api/refresh: got %d %+v", resp.StatusCode, refreshed)
+	}
+	resp = doJSON(t, srv, "POST", "/api/chirps", refreshed.Token, map[string]string{"body": "hello"}, nil)
+	if resp.StatusCode != 201 {
+		t.Errorf("POST /api/chirps with refreshed token: got %d, want 201", resp.StatusCode)
+	}
+	// The first refresh rotated the token, so using it again is reuse.
+	resp = doJSON(t, srv, "POST", "/api/refresh", alice.RefreshToken, nil, nil)
+	if resp.StatusCode != 401 {
+		t.Errorf("reusing a rotated refresh token: got %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestGETChirpByIDInvalid(t *testing.T) {
+	srv := newTestServer(t)
+	tests := []struct {
+		id   string
+		want int
+	}{
+		{"abc", 400},
+		{"1x", 400},
+		{"42", 404},
+	}
+	for _, tt := range tests {
+		resp := doJSON(t, srv, "GET", "/api/chirps/"+tt.id, "", nil, nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("GET /api/chirps/%s: got %d, want %d", tt.id, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestPUTUserEmailTaken(t *testing.T) {
+	srv := newTestServer(t)
+	signUp(t, srv, "alice@example.com")
+	bob := signUp(t, srv, "bob@example.com")
+
+	creds := map[string]string{"email": "alice@example.com", "password": "hunter2"}
+	resp := doJSON(t, srv, "PUT", "/api/users", bob.Token, creds, nil)
+	if resp.StatusCode != 409 {
+		t.Errorf("taking another user's email: got %d, want 409", resp.StatusCode)
+	}
+	creds["email"] = "bob@example.com"
+	resp = doJSON(t, srv, "PUT", "/api/users", bob.Token, creds, nil)
+	if resp.StatusCode != 200 {
+		t.Errorf("keeping the same email: got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestGETChirpIfNoneMatch(t *testing.T) {
+	srv := newTestServer(t)
+	alice := signUp(t, srv, "alice@example.com")
+	chirp := database.Chirp{}
+	resp := doJSON(t, srv, "POST", "/api/chirps", alice.Token, map[string]string{"body": "hello"}, &chirp)
+	tag := resp.Header.Get("ETag")
+	if resp.StatusCode != 201 || tag == "" {
+		t.Fatalf("POST /api/chirps: got %d with ETag %q", resp.StatusCode, tag)
+	}
+
+	path := fmt.Sprintf("/api/chirps/%d", chirp.Id)
+	tests := []struct {
+		ifNoneMatch string
+		want        int
+	}{
+		{tag, 304},
+		{"W/" + tag, 304},
+		{`"v0", ` + tag, 304},
+		{"*", 304},
+		{`"v0"`, 200},
+	}
+	for _, tt := range tests {
+		resp := doJSONWithHeader(t, srv, "GET", path, "", http.Header{"If-None-Match": {tt.ifNoneMatch}}, nil, nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("If-None-Match %s: got %d, want %d", tt.ifNoneMatch, resp.StatusCode, tt.want)
+		}
+		if got := resp.Header.Get("ETag"); got != tag {
+			t.Errorf("If-None-Match %s: got ETag %q, want %q", tt.ifNoneMatch, got, tag)
+		}
+	}
+}
+
+func TestPUTUserIfMatch(t *testing.T) {
+	srv := newTestServer(t)
+	alice := signUp(t, srv, "alice@example.com")
+	creds := map[string]string{"email": "alice@example.org", "password": "hunter2"}
+
+	resp := doJSONWithHeader(t, srv, "PUT", "/api/users", alice.Token, http.Header{"If-Match": {`"v0"`}}, creds, nil)
+	if resp.StatusCode != 412 {
+		t.Fatalf("stale If-Match: got %d, want 412", resp.StatusCode)
+	}
+	// The refused update changed nothing, so the old email still logs in.
+	resp = doJSON(t, srv, "POST", "/api/login", "", map[string]string{"email": "alice@example.com", "password": "hunter2"}, nil)
+	if resp.StatusCode != 200 {
+		t.Errorf("login after a refused update: got %d, want 200", resp.StatusCode)
+	}
+
+	resp = doJSONWithHeader(t, srv, "PUT", "/api/users", alice.Token, http.Header{"If-Match": {`"v1"`}}, creds, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("current If-Match: got %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("ETag"); got != `"v2"` {
+		t.Errorf("got ETag %q, want \"v2\"", got)
+	}
+	// The ETag the first update was made against is now stale too.
+	resp = doJSONWithHeader(t, srv, "PUT", "/api/users", alice.Token, http.Header{"If-Match": {`"v1"`}}, creds, nil)
+	if resp.StatusCode != 412 {
+		t.Errorf("reused If-Match: got %d, want 412", resp.StatusCode)
+	}
+}
+
+func TestDELETEChirpIfMatch(t *testing.T) {
+	srv := newTestServer(t)
+	alice := signUp(t, srv, "alice@example.com")
+	chirp := database.Chirp{}
+	resp := doJSON(t, srv, "POST", "/api/chirps", alice.Token, map[string]string{"body": "hello"}, &chirp)
+	tag := resp.Header.Get("ETag")
+	path := fmt.Sprintf("/api/chirps/%d", chirp.Id)
+
+	resp = doJSONWithHeader(t, srv, "DELETE", path, alice.Token, http.Header{"If-Match": {`"v0"`}}, nil, nil)
+	if resp.StatusCode != 412 {
+		t.Errorf("stale If-Match: got %d, want 412", resp.StatusCode)
+	}
+	resp = doJSON(t, srv, "GET", path, "", nil, nil)
+	if resp.StatusCode != 200 {
+		t.Errorf("GET after a refused delete: got %d, want 200", resp.StatusCode)
+	}
+	resp = doJSONWithHeader(t, srv, "DELETE", path, alice.Token, http.Header{"If-Match": {tag}}, nil, nil)
+	if resp.StatusCode != 204 {
+		t.Errorf("current If-Match: got %d, want 204", resp.StatusCode)
+	}
+}
+
+// postDeletedChirp creates a chirp as author and deletes it, returning its
+// path.
+func postDeletedChirp(t *testing.T, srv *httptest.Server, author loginResponse) string {
+	t.Helper()
+	chirp := database.Chirp{}
+	resp := doJSON(t, srv, "POST", "/api/chirps", author.Token, map[string]string{"body": "hello"}, &chirp)
+	if resp.StatusCode != 201 {
+		t.Fatalf("POST /api/chirps: got %d, want 201", resp.StatusCode)
+	}
+	path := fmt.Sprintf("/api/chirps/%d", chirp.Id)
+	resp = doJSON(t, srv, "DELETE", path, author.Token, nil, nil)
+	if resp.StatusCode != 204 {
+		t.Fatalf("DELETE %s: got %d, want 204", path, resp.StatusCode)
+	}
+	return path
+}
+
+func TestUndeleteChirpPermissions(t *testing.T) {
+	t.Setenv("ADMIN_API_KEY", "admin-key")
+	srv := newTestServer(t)
+	alice := signUp(t, srv, "alice@example.com")
+	bob := signUp(t, srv, "bob@example.com")
+	path := postDeletedChirp(t, srv, alice)
+
+	resp := doJSON(t, srv, "POST", path+"/undelete", bob.Token, nil, nil)
+	if resp.StatusCode != 403 {
+		t.Errorf("undelete by another user: got %d, want 403", resp.StatusCode)
+	}
+	// The restore was rolled back, so the chirp is still deleted.
+	resp = doJSON(t, srv, "GET", path, "", nil, nil)
+	if resp.StatusCode != 410 {
+		t.Errorf("GET after a refused undelete: got %d, want 410", resp.StatusCode)
+	}
+	resp = doJSON(t, srv, "POST", path+"/undelete", "", nil, nil)
+	if resp.StatusCode != 401 {
+		t.Errorf("anonymous undelete: got %d, want 401", resp.StatusCode)
+	}
+
+	resp = doJSON(t, srv, "POST", path+"/undelete", alice.Token, nil, nil)
+	if resp.StatusCode != 200 {
+		t.Errorf("undelete by the author: got %d, want 200", resp.StatusCode)
+	}
+	resp = doJSON(t, srv, "POST", path+"/undelete", alice.Token, nil, nil)
+	if resp.StatusCode != 409 {
+		t.Errorf("undeleting a live chirp: got %d, want 409", resp.StatusCode)
+	}
+
+	path = postDeletedChirp(t, srv, alice)
+	admin := http.Header{"Authorization": {"ApiKey admin-key"}}
+	resp = doJSONWithHeader(t, srv, "POST", path+"/undelete", "", admin, nil, nil)
+	if resp.StatusCode != 200 {
+		t.Errorf("undelete by an admin: got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestUndeleteChirpAfterWindow(t *testing.T) {
+	t.Setenv("CHIRP_UNDELETE_WINDOW", "1ms")
+	srv := newTestServer(t)
+	alice := signUp(t, srv, "alice@example.com")
+	path := postDeletedChirp(t, srv, alice)
+	time.Sleep(10 * time.Millisecond)
+
+	resp := doJSON(t, srv, "POST", path+"/undelete", alice.Token, nil, nil)
+	if resp.StatusCode != 410 {
+		t.Errorf("undelete after the window: got %d, want 410", resp.StatusCode)
+	}
+	resp = doJSON(t, srv, "GET", path, "", nil, nil)
+	if resp.StatusCode != 410 {
+		t.Errorf("GET after a late undelete: got %d, want 410", resp.StatusCode)
+	}
+}
+
+func TestSearchChirpsHandler(t *testing.T) {
+	srv := newTestServer(t)
+	alice := signUp(t, srv, "alice@example.com")
+	bob := signUp(t, srv, "bob@example.com")
+	for _, post := range []struct {
+		author loginResponse
+		body   string
+	}{
+		{alice, "The quick brown fox"},
+		{bob, "A lazy brown dog"},
+		{alice, "brown brown bread"},
+	} {
+		resp := doJSON(t, srv, "POST", "/api/chirps", post.author.Token, map[string]string{"body": post.body}, nil)
+		if resp.StatusCode != 201 {
+			t.Fatalf("POST /api/chirps: got %d, want 201", resp.StatusCode)
+		}
+	}
+
+	chirps := []database.Chirp{}
+	resp := doJSON(t, srv, "GET", fmt.Sprintf("/api/chirps/search?q=brown&author_id=%d", alice.Id), "", nil, &chirps)
+	if resp.StatusCode != 200 || len(chirps) != 2 || chirps[0].Body != "brown brown bread" {
+		t.Errorf("search by author: got %d %+v", resp.StatusCode, chirps)
+	}
+
+	// Following the Link header walks the ranked results a page at a time.
+	bodies := []string{}
+	path := "/api/chirps/search?q=brown&limit=1"
+	for path != "" {
+		chirps = []database.Chirp{}
+		resp = doJSON(t, srv, "GET", path, "", nil, &chirps)
+		if resp.StatusCode != 200 || len(chirps) != 1 {
+			t.Fatalf("GET %s: got %d with %d chirps", path, resp.StatusCode, len(chirps))
+		}
+		bodies = append(bodies, chirps[0].Body)
+		path = ""
+		for _, link := range strings.Split(resp.Header.Get("Link"), ", ") {
+			if target, found := strings.CutSuffix(link, `; rel="next"`); found {
+				path = strings.Trim(target, "<>")
+			}
+		}
+	}
+	if want := []string{"brown brown bread", "A lazy brown dog", "The quick brown fox"}; fmt.Sprint(bodies) != fmt.Sprint(want) {
+		t.Errorf("got pages %q, want %q", bodies, want)
+	}
+
+	for _, path := range []string{
+		"/api/chirps/search",
+		"/api/chirps/search?q=%22quick+brown",
+		"/api/chirps/search?q=fox&author_id=alice",
+		"/api/chirps/search?q=fox&cursor=nope",
+	} {
+		resp = doJSON(t, srv, "GET", path, "", nil, nil)
+		if resp.StatusCode != 400 {
+			t.Errorf("GET %s: got %d, want 400", path, resp.StatusCode)
+		}
+	}
+}
+
+// chdirTemp switches to a new directory holding files, each containing its
+// own name, for the length of the test. /app/ serves the working directory.
+func chdirTemp(t *testing.T, files ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err == nil {
+			err = os.WriteFile(path, []byte(name), 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// getStatus fetches path and returns the status code.
+func getStatus(t *testing.T, srv *httptest.Server, path string) int {
+	t.Helper()
+	resp, err := srv.Client().Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAppHidesPrivateFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		// env maps variables to paths relative to the served directory,
+		// which are made absolute when abs is set.
+		env map[string]string
+		abs bool
+	}{
+		{"defaults", nil, false},
+		{"relative paths", map[string]string{"DB_PATH": "data/chirpy.json", "BACKUP_DIR": "archives"}, false},
+		{"absolute paths", map[string]string{"DB_PATH": "data/chirpy.json", "BACKUP_DIR": "archives"}, true},
+		{"absolute default names", map[string]string{"DB_PATH": "database.json", "BACKUP_DIR": "backups"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbFile, backupDir := "database.json", "backups"
+			if tt.env != nil {
+				dbFile, backupDir = tt.env["DB_PATH"], tt.env["BACKUP_DIR"]
+			}
+			dir := chdirTemp(t, "index.html", ".env", ".git/config", "assets/logo.png",
+				dbFile, dbFile+".bak", dbFile+".journal", backupDir+"/chirpy-1.snapshot")
+			for name, path := range tt.env {
+				if tt.abs {
+					path = filepath.Join(dir, path)
+				}
+				t.Setenv(name, path)
+			}
+			srv := newTestServer(t)
+
+			paths := map[string]int{
+				"/app/index.html":                          200,
+				"/app/assets/logo.png":                     200,
+				"/app/.env":                                404,
+				"/app/%2eenv":                              404,
+				"/app/.git/config":                         404,
+				"/app/assets/../.env":                      404,
+				"/app/" + dbFile:                           404,
+				"/app/" + dbFile + ".bak":                  404,
+				"/app/" + dbFile + ".journal":              404,
+				"/app/" + backupDir + "/chirpy-1.snapshot": 404,
+			}
+			for path, want := range paths {
+				if got := getStatus(t, srv, path); got != want {
+					t.Errorf("GET %s: got %d, want %d", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAppHidesKeyFiles(t *testing.T) {
+	dir := chdirTemp(t, "index.html", "keys/signing.pem", "keys/old.pem", "keys/public.pem")
+	// Only the paths are read here; nothing in this test loads the keys,
+	// which tokenKeys would cache for the rest of the run.
+	t.Setenv("JWT_SIGNING_KEY", filepath.Join(dir, "keys/signing.pem"))
+	t.Setenv("JWT_VERIFICATION_KEYS", "keys/old.pem, ")
+	srv := newTestServer(t)
+	paths := map[string]int{
+		"/app/index.html":       200,
+		"/app/keys/public.pem":  200,
+		"/app/keys/signing.pem": 404,
+		"/app/keys/old.pem":     404,
+		"/app/keys/./old.pem":   404,
+	}
+	for path, want := range paths {
+		if got := getStatus(t, srv, path); got != want {
+			t.Errorf("GET %s: got %d, want %d", path, got, want)
+		}
+	}
+}